@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/bencromwell/sshush/sshush"
+	"github.com/spf13/cobra"
+)
+
+// newAnsibleInventoryCommand creates the ansible-inventory command, which
+// prints the resolved hosts as an Ansible inventory.
+func newAnsibleInventoryCommand(version string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ansible-inventory",
+		Short: "Print the hosts as an Ansible inventory",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			format, err := cmd.Flags().GetString("format")
+			must(err)
+
+			config, err := resolveProfile(cmd, version, false)
+			if err != nil {
+				return err
+			}
+
+			return sshush.EncodeAnsibleInventory(cmd.OutOrStdout(), config, format)
+		},
+	}
+
+	cmd.Flags().String("format", sshush.FormatINI, "the inventory format: ini or yaml")
+	must(cmd.RegisterFlagCompletionFunc(
+		"format",
+		cobra.FixedCompletions(
+			[]string{sshush.FormatINI, sshush.FormatYAML},
+			cobra.ShellCompDirectiveNoFileComp,
+		),
+	))
+
+	return cmd
+}
@@ -2,6 +2,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -46,40 +47,121 @@ func NewRootCommand(version, commit string) *cobra.Command {
 		Short:   "sshush",
 		Version: fmt.Sprintf("%s (%s)", version, commit),
 		Run: func(cmd *cobra.Command, _ []string) {
-			sources := viper.GetStringSlice("source")
-			dest := viper.GetString("dest")
-
-			fileSources := expandGlobs(sources)
-
-			runner := &sshush.Runner{
-				Sources:     fileSources,
-				Destination: dest,
-				Out:         os.Stdout,
-			}
-
 			verbose, err := cmd.Flags().GetBool("verbose")
 			must(err)
 			debug, err := cmd.Flags().GetBool("debug")
 			must(err)
 			dryRun, err := cmd.Flags().GetBool("dry-run")
 			must(err)
+			format, err := cmd.Flags().GetString("format")
+			must(err)
+			toStdout, err := cmd.Flags().GetBool("stdout")
+			must(err)
+			allProfiles, err := cmd.Flags().GetBool("all-profiles")
+			must(err)
 
-			err = runner.Run(verbose, debug, dryRun, version)
+			profiles, err := selectProfiles(cmd, allProfiles)
 			must(err)
+
+			for _, profile := range profiles {
+				if toStdout {
+					profile.Dest = sshush.StdoutDestination
+				}
+
+				runner, err := profile.runner(cmd.Context())
+				must(err)
+
+				opts := profile.options(version)
+				opts.Verbose = verbose
+				opts.Debug = debug
+				opts.DryRun = dryRun
+
+				if verbose && profile.Name != "" {
+					opts.Logger.Info("Generating profile " + profile.Name)
+				}
+
+				if format != "" {
+					config, err := runner.Resolve(cmd.Context(), opts)
+					must(err)
+					must(sshush.EncodeConfig(runner.Out, config, format))
+
+					continue
+				}
+
+				err = runner.Run(cmd.Context(), opts)
+				must(err)
+			}
 		},
 	}
 
 	homeDir, err := os.UserHomeDir()
 	must(err)
 
-	cmd.PersistentFlags().StringSlice("source", []string{}, "the source file(s) to read from")
-	cmd.PersistentFlags().String("dest", homeDir+"/.ssh/config", "the destination path to write to")
+	cmd.AddCommand(newWatchCommand(version))
+	cmd.AddCommand(newListCommand(version))
+	cmd.AddCommand(newHostsCommand(version))
+	cmd.AddCommand(newAnsibleInventoryCommand(version))
+	cmd.AddCommand(newKnownHostsCommand(version))
+
+	cmd.PersistentFlags().StringSlice(
+		"source",
+		[]string{},
+		"the source file(s) to read from, or - to read from stdin",
+	)
+	cmd.PersistentFlags().String(
+		"dest",
+		homeDir+"/.ssh/config",
+		"the destination path to write to, or - to write to stdout",
+	)
+	cmd.PersistentFlags().String(
+		"known-hosts",
+		"",
+		"where to write the known_hosts for declared host keys (default dest.known_hosts)",
+	)
+	cmd.PersistentFlags().Bool("hash-known-hosts", false, "hash the host names in the known_hosts")
+	cmd.PersistentFlags().String("profile", "", "the profile from sshush.yaml to use")
+	cmd.PersistentFlags().StringSlice(
+		"include-tags",
+		[]string{},
+		"only include hosts with at least one of these tags",
+	)
+	cmd.PersistentFlags().StringSlice(
+		"exclude-tags",
+		[]string{},
+		"leave out hosts with any of these tags",
+	)
+	cmd.PersistentFlags().Duration(
+		"exec-timeout",
+		sshush.DefaultExecTimeout,
+		"how long an exec: source may run for",
+	)
+	cmd.PersistentFlags().Duration(
+		"exec-cache-ttl",
+		0,
+		"reuse the output of exec: sources for this long rather than running them again",
+	)
 	cmd.PersistentFlags().BoolP("verbose", "V", false, "verbose output")
 	cmd.PersistentFlags().Bool("debug", false, "debug output")
 	cmd.PersistentFlags().Bool("dry-run", false, "print diff with current file instead of writing")
+	cmd.Flags().Bool("all-profiles", false, "generate every profile from sshush.yaml")
+	cmd.Flags().Bool("stdout", false, "write the config to stdout, the same as --dest -")
+	cmd.Flags().String(
+		"format",
+		"",
+		"print the resolved hosts as json or yaml instead of writing the config",
+	)
+
+	must(cmd.RegisterFlagCompletionFunc("include-tags", completeTags(version)))
+	must(cmd.RegisterFlagCompletionFunc("exclude-tags", completeTags(version)))
 
 	must(viper.BindPFlag("source", cmd.PersistentFlags().Lookup("source")))
 	must(viper.BindPFlag("dest", cmd.PersistentFlags().Lookup("dest")))
+	must(viper.BindPFlag("include_tags", cmd.PersistentFlags().Lookup("include-tags")))
+	must(viper.BindPFlag("exclude_tags", cmd.PersistentFlags().Lookup("exclude-tags")))
+	must(viper.BindPFlag("known_hosts", cmd.PersistentFlags().Lookup("known-hosts")))
+	must(viper.BindPFlag("hash_known_hosts", cmd.PersistentFlags().Lookup("hash-known-hosts")))
+	must(viper.BindPFlag("exec_timeout", cmd.PersistentFlags().Lookup("exec-timeout")))
+	must(viper.BindPFlag("exec_cache_ttl", cmd.PersistentFlags().Lookup("exec-cache-ttl")))
 
 	viper.SetConfigName("sshush")
 	viper.SetConfigType("yaml")
@@ -99,22 +181,47 @@ func NewRootCommand(version, commit string) *cobra.Command {
 }
 
 // expandGlobs expands glob patterns and handles tilde and environment variables.
-func expandGlobs(sources []string) []string {
+func expandGlobs(ctx context.Context, sources []string) ([]string, error) {
 	var fileSources []string
 
-	for _, pattern := range sources {
+	for _, source := range sources {
+		// A prefix such as ansible: is kept, and the path after it expanded.
+		prefix, pattern := sshush.SplitSource(source)
+
+		// Stdin, commands and URLs aren't paths, so there's nothing to expand.
+		if pattern == sshush.StdinSource || prefix == sshush.ExecSourcePrefix ||
+			sshush.IsURLSource(pattern) {
+			fileSources = append(fileSources, source)
+
+			continue
+		}
+
+		// Globs in a git source match files in the repository.
+		if prefix == sshush.GitSourcePrefix {
+			gitSources, err := sshush.ExpandGitSource(ctx, source)
+			if err != nil {
+				return nil, fmt.Errorf("expanding git source: %w", err)
+			}
+
+			fileSources = append(fileSources, gitSources...)
+
+			continue
+		}
+
 		expandedPattern, err := expandPath(pattern)
 		if err != nil {
-			must(fmt.Errorf("expanding path: %w", err))
+			return nil, fmt.Errorf("expanding path: %w", err)
 		}
 
 		matches, err := filepath.Glob(expandedPattern)
 		if err != nil {
-			must(fmt.Errorf("expanding glob pattern: %w", err))
+			return nil, fmt.Errorf("expanding glob pattern: %w", err)
 		}
 
-		fileSources = append(fileSources, matches...)
+		for _, match := range matches {
+			fileSources = append(fileSources, prefix+match)
+		}
 	}
 
-	return fileSources
+	return fileSources, nil
 }
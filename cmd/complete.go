@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/bencromwell/sshush/sshush"
+	"github.com/spf13/cobra"
+)
+
+// completionFunc completes an argument or flag value.
+type completionFunc func(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective)
+
+// resolveProfile resolves the hosts of the selected profile, without writing
+// anything. When quiet, as it is for completions, which the shell reads from
+// stdout, nothing is logged or printed whatever --verbose and --debug say.
+func resolveProfile(cmd *cobra.Command, version string, quiet bool) (*sshush.Config, error) {
+	verbose, err := cmd.Flags().GetBool("verbose")
+	must(err)
+	debug, err := cmd.Flags().GetBool("debug")
+	must(err)
+
+	profiles, err := selectProfiles(cmd, false)
+	if err != nil {
+		return nil, err
+	}
+
+	runner, err := profiles[0].runner(cmd.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	opts := profiles[0].options(version)
+	opts.Verbose = verbose
+	opts.Debug = debug
+
+	if quiet {
+		opts.Verbose = false
+		opts.Debug = false
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		runner.Out = io.Discard
+	}
+
+	config, err := runner.Resolve(cmd.Context(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("resolving hosts: %w", err)
+	}
+
+	return config, nil
+}
+
+// completeHosts completes a single host alias, described by its HostName.
+// Wildcard hosts can't be connected to by name, so they're left out.
+func completeHosts(version string) completionFunc {
+	return func(
+		cmd *cobra.Command,
+		args []string,
+		toComplete string,
+	) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		config, err := resolveProfile(cmd, version, true)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+
+		var completions []string
+
+		for _, host := range config.Hosts() {
+			if host.Pattern || !strings.HasPrefix(host.Alias, toComplete) {
+				continue
+			}
+
+			completions = append(completions, host.Alias+"\t"+host.Value("HostName"))
+		}
+
+		return completions, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeTags completes the tags used by any host, for the comma separated
+// tag flags.
+func completeTags(version string) completionFunc {
+	return func(
+		cmd *cobra.Command,
+		_ []string,
+		toComplete string,
+	) ([]string, cobra.ShellCompDirective) {
+		config, err := resolveProfile(cmd, version, true)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+
+		// Only the tag after the last comma is being completed.
+		previous := ""
+		if i := strings.LastIndex(toComplete, ","); i != -1 {
+			previous, toComplete = toComplete[:i+1], toComplete[i+1:]
+		}
+
+		var completions []string
+
+		for _, tag := range config.Tags() {
+			if strings.HasPrefix(tag, toComplete) {
+				completions = append(completions, previous+tag)
+			}
+		}
+
+		return completions, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// newHostsCommand creates the hosts command, which prints the host aliases
+// one per line for shells to complete ssh, scp and the like with.
+func newHostsCommand(version string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "hosts",
+		Short: "Print the host aliases, one per line, for shell completion",
+		Long: `Print the host aliases, one per line, for shell completion of ssh.
+Wildcard hosts are left out.
+
+bash:  complete -o default -W "$(sshush hosts)" ssh scp
+zsh:   zstyle ':completion:*:(ssh|scp):*' hosts $(sshush hosts)
+fish:  complete -c ssh -f -a "(sshush hosts)"`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config, err := resolveProfile(cmd, version, false)
+			if err != nil {
+				return err
+			}
+
+			for _, host := range config.Hosts() {
+				if !host.Pattern {
+					_, err = fmt.Fprintln(cmd.OutOrStdout(), host.Alias)
+					if err != nil {
+						return fmt.Errorf("writing hosts: %w", err)
+					}
+				}
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompleteHostsQuiet checks that --verbose and --debug don't put
+// anything but the completions on stdout, as the shell reads them from there.
+func TestCompleteHostsQuiet(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+
+	source := filepath.Join(dir, "hosts.yml")
+	require.NoError(t, os.WriteFile(source, []byte("web:\n  Hosts:\n    web-1: 10.0.0.1\n"), 0o600))
+
+	var completions bytes.Buffer
+
+	root := NewRootCommand("0.0.0-dev", "")
+	root.SetOut(&completions)
+	root.SetArgs([]string{
+		cobra.ShellCompRequestCmd, "list", "--source", source, "--verbose", "--debug", "",
+	})
+
+	stdout := captureStdout(t, func() {
+		require.NoError(t, root.Execute())
+	})
+
+	assert.Empty(t, stdout)
+	assert.Contains(t, completions.String(), "web-1\t10.0.0.1")
+}
+
+// captureStdout returns whatever fn writes to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	captured := make(chan []byte)
+
+	go func() {
+		contents, _ := io.ReadAll(reader)
+		captured <- contents
+	}()
+
+	fn()
+
+	require.NoError(t, writer.Close())
+
+	return string(<-captured)
+}
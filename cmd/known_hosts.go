@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+// newKnownHostsCommand creates the known-hosts command, for managing
+// known_hosts files against the hosts in the sources.
+func newKnownHostsCommand(version string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "known-hosts",
+		Short: "Manage known_hosts files against the hosts in the sources",
+		Args:  cobra.NoArgs,
+	}
+
+	cmd.AddCommand(newKnownHostsPruneCommand(version))
+
+	return cmd
+}
+
+// newKnownHostsPruneCommand creates the known-hosts prune command, which
+// removes entries for hosts that are no longer in the sources.
+func newKnownHostsPruneCommand(version string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove known_hosts entries for hosts that are no longer in the sources",
+		Long: `Remove known_hosts entries for hosts that are no longer in the sources.
+
+sshush records the hosts each generated config manages. Entries for those
+hosts, including hashed entries, are removed once none of their names is the
+alias or HostName of a host in the sources, such as when a host has been
+renamed or decommissioned, so that a reused IP address doesn't later look like
+a changed host key. Entries for hosts sshush never managed are kept.
+
+Use --all to remove every entry that isn't in the sources, --keep for hosts to
+keep regardless, such as github.com, and --dry-run to see what would be removed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			verbose, err := cmd.Flags().GetBool("verbose")
+			must(err)
+			debug, err := cmd.Flags().GetBool("debug")
+			must(err)
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			must(err)
+			file, err := cmd.Flags().GetString("file")
+			must(err)
+			keep, err := cmd.Flags().GetStringSlice("keep")
+			must(err)
+			all, err := cmd.Flags().GetBool("all")
+			must(err)
+
+			file, err = expandPath(file)
+			if err != nil {
+				return fmt.Errorf("expanding path: %w", err)
+			}
+
+			profiles, err := selectProfiles(cmd, false)
+			if err != nil {
+				return err
+			}
+
+			runner, err := profiles[0].runner(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			runner.Out = cmd.OutOrStdout()
+
+			opts := profiles[0].options(version)
+			opts.Verbose = verbose
+			opts.Debug = debug
+			opts.DryRun = dryRun
+
+			pruned, err := runner.PruneKnownHosts(cmd.Context(), opts, file, keep, all)
+			if err != nil {
+				return fmt.Errorf("pruning known hosts: %w", err)
+			}
+
+			if !dryRun {
+				slog.Info(fmt.Sprintf("Pruned %d entries from %s", len(pruned), file))
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().String("file", "~/.ssh/known_hosts", "the known_hosts file to prune")
+	cmd.Flags().StringSlice(
+		"keep",
+		[]string{},
+		"host name patterns to keep even though they aren't in the sources",
+	)
+	cmd.Flags().Bool(
+		"all",
+		false,
+		"remove every entry that isn't in the sources, not just hosts sshush managed",
+	)
+
+	return cmd
+}
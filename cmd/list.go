@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/bencromwell/sshush/sshush"
+	"github.com/spf13/cobra"
+)
+
+// newListCommand creates the list command, which prints the resolved hosts
+// without writing the config.
+func newListCommand(version string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list [query]",
+		Short: "List the hosts, optionally those matching a query",
+		Long: `List the resolved hosts with their HostName, User, group and tags.
+
+The query matches hosts whose alias, HostName or group contain it, then those
+whose alias contains its characters in order, so "pdb" finds "prod-db1".`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeHosts(version),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, err := cmd.Flags().GetString("format")
+			must(err)
+
+			config, err := resolveProfile(cmd, version, false)
+			if err != nil {
+				return err
+			}
+
+			hosts := config.Hosts()
+			if len(args) > 0 {
+				hosts = sshush.SearchHosts(hosts, args[0])
+			}
+
+			return sshush.ListHosts(cmd.OutOrStdout(), hosts, format)
+		},
+	}
+
+	cmd.Flags().String("format", sshush.FormatTable, "the output format: table, json or yaml")
+	must(cmd.RegisterFlagCompletionFunc(
+		"format",
+		cobra.FixedCompletions(
+			[]string{sshush.FormatTable, sshush.FormatJSON, sshush.FormatYAML},
+			cobra.ShellCompDirectiveNoFileComp,
+		),
+	))
+
+	return cmd
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bencromwell/sshush/sshush"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// profile is a named pair of sources and destination from sshush.yaml,
+	// along with the variables to interpolate into its sources and the tags
+	// to filter its hosts by.
+	profile struct {
+		Name        string            `mapstructure:"-"`
+		Source      []string          `mapstructure:"source"`
+		Dest        string            `mapstructure:"dest"`
+		KnownHosts  string            `mapstructure:"known_hosts"`
+		IncludeTags []string          `mapstructure:"include_tags"`
+		ExcludeTags []string          `mapstructure:"exclude_tags"`
+		Vars        map[string]string `mapstructure:"-"`
+	}
+
+	// configFileVars is the vars from sshush.yaml. They're read directly
+	// rather than through viper, as viper lower cases keys and variable names
+	// are case sensitive.
+	configFileVars struct {
+		Vars     map[string]string `yaml:"vars"`
+		Profiles map[string]struct {
+			Vars map[string]string `yaml:"vars"`
+		} `yaml:"profiles"`
+	}
+)
+
+var (
+	errUnknownProfile      = errors.New("unknown profile")
+	errNoProfiles          = errors.New("no profiles are defined in sshush.yaml")
+	errAllProfilesWithPath = errors.New("--all-profiles can't be combined with --source or --dest")
+	errSameDestination     = errors.New("profiles write to the same file")
+)
+
+// selectProfiles returns the profiles to generate. That's every profile if
+// all is set, otherwise the one named by --profile or default_profile.
+// Without either of those, the top level source and dest make up a single
+// unnamed profile, as they did before profiles existed.
+// Explicit --source, --dest and tag flags override the selected profile's.
+func selectProfiles(cmd *cobra.Command, all bool) ([]profile, error) {
+	profiles := make(map[string]profile)
+
+	err := viper.UnmarshalKey("profiles", &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("reading profiles: %w", err)
+	}
+
+	if all {
+		return allProfiles(cmd, profiles)
+	}
+
+	name, err := cmd.Flags().GetString("profile")
+	if err != nil {
+		return nil, fmt.Errorf("reading profile flag: %w", err)
+	}
+
+	if name == "" {
+		name = viper.GetString("default_profile")
+	}
+
+	if name == "" {
+		vars, err := profileVars("")
+		if err != nil {
+			return nil, err
+		}
+
+		return []profile{{
+			Source:      viper.GetStringSlice("source"),
+			Dest:        viper.GetString("dest"),
+			KnownHosts:  viper.GetString("known_hosts"),
+			IncludeTags: viper.GetStringSlice("include_tags"),
+			ExcludeTags: viper.GetStringSlice("exclude_tags"),
+			Vars:        vars,
+		}}, nil
+	}
+
+	// Viper lower cases keys, so profile names are case insensitive.
+	selected, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownProfile, name)
+	}
+
+	selected.Name = name
+
+	selected.Vars, err = profileVars(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(selected.Source) == 0 || cmd.Flags().Changed("source") {
+		selected.Source = viper.GetStringSlice("source")
+	}
+
+	if selected.Dest == "" || cmd.Flags().Changed("dest") {
+		selected.Dest = viper.GetString("dest")
+	}
+
+	if selected.KnownHosts == "" || cmd.Flags().Changed("known-hosts") {
+		selected.KnownHosts = viper.GetString("known_hosts")
+	}
+
+	if cmd.Flags().Changed("include-tags") {
+		selected.IncludeTags = viper.GetStringSlice("include_tags")
+	}
+
+	if cmd.Flags().Changed("exclude-tags") {
+		selected.ExcludeTags = viper.GetStringSlice("exclude_tags")
+	}
+
+	return []profile{selected}, nil
+}
+
+// allProfiles returns every profile, sorted by name.
+func allProfiles(cmd *cobra.Command, profiles map[string]profile) ([]profile, error) {
+	if cmd.Flags().Changed("source") || cmd.Flags().Changed("dest") {
+		return nil, errAllProfilesWithPath
+	}
+
+	if len(profiles) == 0 {
+		return nil, errNoProfiles
+	}
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	selected := make([]profile, 0, len(profiles))
+
+	for _, name := range names {
+		p := profiles[name]
+		p.Name = name
+
+		if len(p.Source) == 0 {
+			p.Source = viper.GetStringSlice("source")
+		}
+
+		if p.Dest == "" {
+			p.Dest = viper.GetString("dest")
+		}
+
+		if p.KnownHosts == "" {
+			p.KnownHosts = viper.GetString("known_hosts")
+		}
+
+		if cmd.Flags().Changed("include-tags") {
+			p.IncludeTags = viper.GetStringSlice("include_tags")
+		}
+
+		if cmd.Flags().Changed("exclude-tags") {
+			p.ExcludeTags = viper.GetStringSlice("exclude_tags")
+		}
+
+		vars, err := profileVars(name)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Vars = vars
+
+		selected = append(selected, p)
+	}
+
+	err := checkDestinations(selected)
+	if err != nil {
+		return nil, err
+	}
+
+	return selected, nil
+}
+
+// checkDestinations checks that no two profiles write to the same file, as
+// they would if they fell back to the same top level dest or known_hosts,
+// with the last one silently overwriting the others.
+func checkDestinations(profiles []profile) error {
+	writers := make(map[string]string)
+
+	for _, p := range profiles {
+		for _, file := range []string{p.Dest, p.KnownHosts} {
+			if file == "" || file == sshush.StdoutDestination {
+				continue
+			}
+
+			path, err := expandPath(file)
+			if err != nil {
+				return fmt.Errorf("expanding path: %w", err)
+			}
+
+			if other, ok := writers[path]; ok {
+				return fmt.Errorf(
+					"%w: %s and %s both write to %s",
+					errSameDestination, other, p.Name, path,
+				)
+			}
+
+			writers[path] = p.Name
+		}
+	}
+
+	return nil
+}
+
+// profileVars returns the top level vars from sshush.yaml, overridden by
+// those of the named profile.
+func profileVars(name string) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	configFile := viper.ConfigFileUsed()
+	if configFile == "" {
+		return vars, nil
+	}
+
+	contents, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	var fileVars configFileVars
+
+	err = yaml.Unmarshal(contents, &fileVars)
+	if err != nil {
+		return nil, fmt.Errorf("reading vars from config: %w", err)
+	}
+
+	maps.Copy(vars, fileVars.Vars)
+
+	for profileName, p := range fileVars.Profiles {
+		if name != "" && strings.EqualFold(profileName, name) {
+			maps.Copy(vars, p.Vars)
+		}
+	}
+
+	return vars, nil
+}
+
+// options returns the options for generating the profile.
+func (p profile) options(version string) sshush.Options {
+	// Without the working directory, command output just isn't cached.
+	workingDir, _ := os.Getwd()
+
+	return sshush.Options{
+		Version:        version,
+		WorkingDir:     workingDir,
+		Logger:         slog.Default(),
+		Vars:           p.Vars,
+		IncludeTags:    p.IncludeTags,
+		ExcludeTags:    p.ExcludeTags,
+		ExecTimeout:    viper.GetDuration("exec_timeout"),
+		ExecCacheTTL:   viper.GetDuration("exec_cache_ttl"),
+		HashKnownHosts: viper.GetBool("hash_known_hosts"),
+	}
+}
+
+// runner creates a runner for the profile, expanding its source globs and
+// the tilde and environment variables in its destination.
+func (p profile) runner(ctx context.Context) (*sshush.Runner, error) {
+	sources, err := expandGlobs(ctx, p.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := p.Dest
+	if dest != sshush.StdoutDestination {
+		dest, err = expandPath(dest)
+		if err != nil {
+			return nil, fmt.Errorf("expanding path: %w", err)
+		}
+	}
+
+	knownHosts := p.KnownHosts
+	if knownHosts != "" {
+		knownHosts, err = expandPath(knownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("expanding path: %w", err)
+		}
+	}
+
+	return &sshush.Runner{
+		Sources:        sources,
+		Destination:    dest,
+		KnownHostsFile: knownHosts,
+		Out:            os.Stdout,
+	}, nil
+}
@@ -0,0 +1,341 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bencromwell/sshush/sshush"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+const defaultDebounce = 300 * time.Millisecond
+
+var errStdinNotWatchable = errors.New("stdin can't be watched as a source")
+
+type (
+	watcher struct {
+		patterns []string
+		runner   *sshush.Runner
+		opts     sshush.Options
+		debounce time.Duration
+		fsw      *fsnotify.Watcher
+		watched  map[string]bool
+		// written is the last config written, to compare against when
+		// writing to stdout.
+		written []string
+	}
+
+	// debouncer calls a function once a burst of events is over, so that
+	// saving several sources at once, or an editor writing a file in several
+	// steps, only regenerates the config once.
+	debouncer[E any] struct {
+		wait time.Duration
+		// after is time.After, replaced in tests to control when the wait is
+		// over.
+		after func(time.Duration) <-chan time.Time
+	}
+)
+
+// newWatchCommand creates the watch command, which regenerates the config
+// whenever one of the sources changes.
+func newWatchCommand(version string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Regenerate the config whenever a source changes",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			verbose, err := cmd.Flags().GetBool("verbose")
+			must(err)
+			debug, err := cmd.Flags().GetBool("debug")
+			must(err)
+			debounce, err := cmd.Flags().GetDuration("debounce")
+			must(err)
+
+			profiles, err := selectProfiles(cmd, false)
+			if err != nil {
+				return err
+			}
+
+			profile := profiles[0]
+			for _, source := range profile.Source {
+				if sshush.SourcePath(source) == sshush.StdinSource {
+					return errStdinNotWatchable
+				}
+			}
+
+			runner, err := profile.runner(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			fsw, err := fsnotify.NewWatcher()
+			if err != nil {
+				return fmt.Errorf("creating watcher: %w", err)
+			}
+			defer fsw.Close()
+
+			opts := profile.options(version)
+			opts.Verbose = verbose
+			opts.Debug = debug
+
+			w := &watcher{
+				patterns: profile.Source,
+				runner:   runner,
+				opts:     opts,
+				debounce: debounce,
+				fsw:      fsw,
+				watched:  make(map[string]bool),
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+
+			return w.run(ctx)
+		},
+	}
+
+	cmd.Flags().Duration(
+		"debounce",
+		defaultDebounce,
+		"how long to wait for further changes before regenerating",
+	)
+
+	return cmd
+}
+
+// run generates the config once and then again after each burst of changes
+// to the sources, until the context is cancelled. Errors are reported but
+// don't stop the watcher.
+func (w *watcher) run(ctx context.Context) error {
+	go func() {
+		for err := range w.fsw.Errors {
+			slog.Error("watching sources", "error", err)
+		}
+	}()
+
+	w.regenerate(ctx)
+
+	d := debouncer[fsnotify.Event]{wait: w.debounce, after: time.After}
+	d.run(ctx, w.fsw.Events, w.relevant, func() {
+		w.regenerate(ctx)
+	})
+
+	return nil
+}
+
+// regenerate resolves the sources again, so that new files matching a glob
+// or newly included are picked up, and only writes the destination if the output has changed.
+func (w *watcher) regenerate(ctx context.Context) {
+	sources, err := expandGlobs(ctx, w.patterns)
+	if err != nil {
+		slog.Error("sshush", "error", err)
+
+		return
+	}
+
+	w.runner.Sources = sources
+	w.watch(sources)
+
+	generated, err := w.runner.Generate(ctx, w.opts)
+	if err != nil {
+		slog.Error("sshush", "error", err)
+
+		return
+	}
+
+	// Watch anything the sources include, too.
+	w.watch(w.runner.Loaded)
+
+	upToDate, err := w.upToDate(generated)
+	if err != nil {
+		slog.Error("sshush", "error", err)
+
+		return
+	}
+
+	if upToDate {
+		if w.opts.Verbose {
+			slog.Info("Config unchanged, not writing " + w.runner.Destination)
+		}
+
+		return
+	}
+
+	err = w.runner.Write(w.opts, generated)
+	if err != nil {
+		slog.Error("sshush", "error", err)
+
+		return
+	}
+
+	w.written = generated.Config
+
+	slog.Info("Regenerated " + w.runner.Destination)
+}
+
+// upToDate reports whether the generated config has already been written.
+// There's no file to compare against for stdout, so it's compared with the
+// last config written instead.
+func (w *watcher) upToDate(generated *sshush.Generated) (bool, error) {
+	if w.runner.Destination == sshush.StdoutDestination {
+		return slices.Equal(w.written, generated.Config), nil
+	}
+
+	upToDate, err := w.runner.UpToDate(w.opts, generated)
+	if err != nil {
+		return false, fmt.Errorf("checking destination: %w", err)
+	}
+
+	return upToDate, nil
+}
+
+// watch adds the directories containing the sources, and those the glob
+// patterns point into, to the watcher. Directories are watched rather than
+// files so that editors which replace the file on save are handled, and so
+// that new files matching a pattern are noticed.
+func (w *watcher) watch(sources []string) {
+	dirs := make([]string, 0, len(sources)+len(w.patterns))
+
+	for _, source := range sources {
+		if path := watchedPath(source); path != "" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+
+	for _, pattern := range w.expandedPatterns() {
+		dir := filepath.Dir(pattern)
+		if !hasMeta(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, dir := range dirs {
+		if w.watched[dir] {
+			continue
+		}
+
+		err := w.fsw.Add(dir)
+		if err != nil {
+			slog.Error("watching directory", "dir", dir, "error", err)
+
+			continue
+		}
+
+		w.watched[dir] = true
+
+		if w.opts.Verbose {
+			slog.Info("Watching " + dir)
+		}
+	}
+}
+
+// relevant reports whether a changed file is, or could become, a source.
+func (w *watcher) relevant(event fsnotify.Event) bool {
+	return sourceChanged(
+		event.Name,
+		slices.Concat(w.runner.Sources, w.runner.Loaded),
+		w.expandedPatterns(),
+	)
+}
+
+// run reads events until the context is cancelled or the channel is closed,
+// calling fn once no relevant event has arrived for the wait. Irrelevant
+// events don't restart the wait.
+func (d debouncer[E]) run(ctx context.Context, events <-chan E, relevant func(E) bool, fn func()) {
+	var done <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			if relevant(event) {
+				done = d.after(d.wait)
+			}
+		case <-done:
+			done = nil
+
+			fn()
+		}
+	}
+}
+
+// sourceChanged reports whether a changed file is, or could become, a
+// source: it's one of the sources, or a file they included, or it matches one
+// of the glob patterns, which should already be expanded.
+func sourceChanged(name string, sources, patterns []string) bool {
+	name = filepath.Clean(name)
+
+	for _, source := range sources {
+		if watchedPath(source) == name {
+			return true
+		}
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expandedPatterns returns the source patterns with the tilde and environment
+// variables expanded. Patterns that can't be expanded are skipped, as
+// regenerate reports them.
+func (w *watcher) expandedPatterns() []string {
+	patterns := make([]string, 0, len(w.patterns))
+
+	for _, pattern := range w.patterns {
+		path := watchedPath(pattern)
+		if path == "" {
+			continue
+		}
+
+		expanded, err := expandPath(path)
+		if err != nil {
+			continue
+		}
+
+		patterns = append(patterns, filepath.Clean(expanded))
+	}
+
+	return patterns
+}
+
+// watchedPath returns the file whose changes affect a source. For a command
+// source that's the command itself, so that editing a script regenerates.
+// URLs and git sources, which are pinned to a ref, have nothing to watch,
+// so it's empty for them.
+func watchedPath(source string) string {
+	prefix, path := sshush.SplitSource(source)
+	if sshush.IsURLSource(path) || prefix == sshush.GitSourcePrefix {
+		return ""
+	}
+
+	if prefix != sshush.ExecSourcePrefix {
+		return path
+	}
+
+	command, _, _ := strings.Cut(strings.TrimSpace(path), " ")
+
+	return filepath.Clean(command)
+}
+
+// hasMeta reports whether the path contains any glob special characters.
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
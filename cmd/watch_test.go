@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bencromwell/sshush/sshush"
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSourceChanged checks which changed files regenerate the config: the
+// sources, the files they include, new files matching a glob and the script
+// behind a command source, but not other files next to them.
+func TestSourceChanged(t *testing.T) {
+	sources := []string{
+		"/home/user/.ssh/sshush/work.yml",
+		sshush.AnsibleSourcePrefix + "/home/user/ansible/hosts.ini",
+		sshush.ExecSourcePrefix + "/home/user/bin/inventory.sh --all",
+		"https://example.com/hosts.yml",
+		sshush.GitSourcePrefix + "https://example.com/repo.git//hosts.yml",
+		// Loaded through an include.
+		"/home/user/.ssh/sshush/shared/common.yml",
+	}
+	patterns := []string{"/home/user/.ssh/sshush/*.yml"}
+
+	for name, want := range map[string]bool{
+		"/home/user/.ssh/sshush/work.yml":          true,
+		"/home/user/.ssh/sshush/new.yml":           true,
+		"/home/user/.ssh/sshush/./personal.yml":    true,
+		"/home/user/.ssh/sshush/shared/common.yml": true,
+		"/home/user/ansible/hosts.ini":             true,
+		"/home/user/bin/inventory.sh":              true,
+		"/home/user/.ssh/sshush/work.yml.swp":      false,
+		"/home/user/.ssh/sshush/shared/other.yml":  false,
+		"/home/user/ansible/group_vars":            false,
+		"hosts.yml":                                false,
+	} {
+		assert.Equal(t, want, sourceChanged(name, sources, patterns), name)
+	}
+}
+
+// TestDebouncer checks that a burst of relevant events runs the function
+// once the last of them has been waited for, and that irrelevant events
+// neither run it nor restart the wait.
+func TestDebouncer(t *testing.T) {
+	events := make(chan string)
+	waits := make(chan chan time.Time)
+	runs := make(chan struct{}, 1)
+
+	d := debouncer[string]{
+		wait: time.Second,
+		after: func(d time.Duration) <-chan time.Time {
+			assert.Equal(t, time.Second, d)
+
+			wait := make(chan time.Time, 1)
+			waits <- wait
+
+			return wait
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		d.run(ctx, events, func(name string) bool {
+			return strings.HasSuffix(name, ".yml")
+		}, func() {
+			runs <- struct{}{}
+		})
+	}()
+
+	events <- "a.yml"
+	first := <-waits
+
+	events <- "b.yml"
+	second := <-waits
+
+	// The first wait was superseded by the second event.
+	first <- time.Now()
+
+	// An irrelevant event doesn't start a wait.
+	events <- "a.yml.swp"
+
+	select {
+	case <-runs:
+		t.Fatal("ran before the burst was over")
+	default:
+	}
+
+	second <- time.Now()
+	<-runs
+
+	// The next burst runs it again.
+	events <- "c.yml"
+	(<-waits) <- time.Now()
+	<-runs
+
+	cancel()
+	<-done
+}
+
+// TestWatchStdout checks that watching with stdout as the destination only
+// writes the config again when it has changed.
+func TestWatchStdout(t *testing.T) {
+	var out bytes.Buffer
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "hosts.yml")
+	require.NoError(t, os.WriteFile(source, []byte("web:\n  Hosts:\n    web-1: 10.0.0.1\n"), 0o600))
+
+	fsw, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+
+	defer fsw.Close()
+
+	w := &watcher{
+		patterns: []string{source},
+		runner: &sshush.Runner{
+			Destination: sshush.StdoutDestination,
+			Out:         &out,
+		},
+		fsw:     fsw,
+		watched: make(map[string]bool),
+	}
+
+	w.regenerate(context.Background())
+	w.regenerate(context.Background())
+	assert.Equal(t, 1, strings.Count(out.String(), "Host web-1"))
+
+	require.NoError(t, os.WriteFile(source, []byte("web:\n  Hosts:\n    web-2: 10.0.0.2\n"), 0o600))
+	w.regenerate(context.Background())
+	assert.Equal(t, 1, strings.Count(out.String(), "Host web-2"))
+}
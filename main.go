@@ -16,7 +16,8 @@ var (
 )
 
 func main() {
-	logger := slog.New(devslog.NewHandler(os.Stdout, nil))
+	// Logs go to stderr, keeping stdout for output such as the config.
+	logger := slog.New(devslog.NewHandler(os.Stderr, nil))
 	slog.SetDefault(logger)
 
 	rootCmd := cmd.NewRootCommand(version, commit)
@@ -0,0 +1,513 @@
+package sshush
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// AnsibleSourcePrefix marks a source as an Ansible inventory rather than
+	// an sshush YAML source, e.g. "ansible:inventory/hosts.ini". Inventories
+	// ending in .yml, .yaml or .json are read as YAML and anything else as
+	// INI.
+	AnsibleSourcePrefix = "ansible:"
+
+	// ansibleAll is the group every host belongs to.
+	ansibleAll = "all"
+	// ansibleUngrouped is the group of hosts that aren't in any other.
+	ansibleUngrouped = "ungrouped"
+)
+
+var (
+	ErrParsingInventory     = errors.New("failed to parse ansible inventory")
+	ErrInvalidInventoryLine = errors.New("invalid inventory line")
+	ErrInvalidHostRange     = errors.New("invalid host range")
+)
+
+type (
+	// ansibleInventory is an inventory's groups and host variables, in the
+	// order they were declared.
+	ansibleInventory struct {
+		groups   *orderedmap.OrderedMap[string, *ansibleGroup]
+		hostVars map[string]map[string]any
+	}
+
+	// ansibleGroup is a single inventory group.
+	ansibleGroup struct {
+		hosts    []string
+		vars     map[string]any
+		children []string
+	}
+
+	// ansibleYAMLGroup is a group in a YAML inventory.
+	ansibleYAMLGroup struct {
+		Hosts    *orderedmap.OrderedMap[string, map[string]any]    `yaml:"hosts"`
+		Vars     map[string]any                                    `yaml:"vars"`
+		Children *orderedmap.OrderedMap[string, *ansibleYAMLGroup] `yaml:"children"`
+	}
+)
+
+// SplitSource splits a source into the prefix naming its type, if it has
+// one, and the path it's read from.
+func SplitSource(source string) (string, string) {
+	for _, prefix := range []string{AnsibleSourcePrefix, ExecSourcePrefix, GitSourcePrefix} {
+		if path, ok := strings.CutPrefix(source, prefix); ok {
+			return prefix, path
+		}
+	}
+
+	return "", source
+}
+
+// SourcePath returns the path a source is read from, without any prefix
+// naming its type. For a command source, that's the command.
+func SourcePath(source string) string {
+	_, path := SplitSource(source)
+
+	return path
+}
+
+// parseAnsibleSource reads an Ansible inventory into the same shape as an
+// sshush source.
+func (p *Parser) parseAnsibleSource(source string) (*parsedSource, error) {
+	path := SourcePath(source)
+
+	contents, err := p.readSource(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrOpeningSourceFile, source, err)
+	}
+
+	var inventory *ansibleInventory
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml", ".json":
+		inventory, err = parseAnsibleYAML(contents)
+	default:
+		inventory, err = parseAnsibleINI(contents)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrParsingInventory, source, err)
+	}
+
+	return &parsedSource{frontMatter: &SourceFrontMatter{}, config: inventory.config()}, nil
+}
+
+// group returns the named group, adding it if it's new.
+func (inv *ansibleInventory) group(name string) *ansibleGroup {
+	group, ok := inv.groups.Get(name)
+	if !ok {
+		group = &ansibleGroup{vars: make(map[string]any)}
+		inv.groups.Set(name, group)
+	}
+
+	return group
+}
+
+// addHost adds the host to the group, merging its variables with any it was
+// given in other groups.
+func (inv *ansibleInventory) addHost(groupName, host string, vars map[string]any) {
+	group := inv.group(groupName)
+	group.hosts = append(group.hosts, host)
+
+	if inv.hostVars[host] == nil {
+		inv.hostVars[host] = make(map[string]any)
+	}
+
+	for key, value := range vars {
+		inv.hostVars[host][key] = value
+	}
+}
+
+// config converts the inventory into sshush groups. A group's children
+// extend it, and groups without a parent extend all if it has any variables.
+// A host in more than one group is only written in the first, as SSH would
+// only use the first anyway.
+func (inv *ansibleInventory) config() *orderedmap.OrderedMap[string, any] {
+	parents := make(map[string]string)
+
+	for pair := inv.groups.Oldest(); pair != nil; pair = pair.Next() {
+		for _, child := range pair.Value.children {
+			if _, ok := parents[child]; !ok && child != pair.Key {
+				parents[child] = pair.Key
+			}
+		}
+	}
+
+	config := orderedmap.New[string, any]()
+	written := make(map[string]bool)
+
+	for pair := inv.groups.Oldest(); pair != nil; pair = pair.Next() {
+		name, group := pair.Key, pair.Value
+		groupConfig := make(map[string]any)
+
+		if directives := ansibleToDirectives(group.vars); len(directives) > 0 {
+			groupConfig["Config"] = directives
+		}
+
+		if parent, ok := parents[name]; ok {
+			groupConfig["Extends"] = parent
+		} else if name != ansibleAll && len(inv.group(ansibleAll).vars) > 0 {
+			groupConfig["Extends"] = ansibleAll
+		}
+
+		hosts := make(map[string]any)
+
+		for _, host := range group.hosts {
+			if written[host] {
+				continue
+			}
+
+			written[host] = true
+			hosts[host] = ansibleToDirectives(inv.hostVars[host])
+		}
+
+		if len(hosts) > 0 {
+			groupConfig["Hosts"] = hosts
+		}
+
+		if name == ansibleUngrouped && len(hosts) == 0 {
+			continue
+		}
+
+		if name == ansibleAll && len(groupConfig) == 0 {
+			continue
+		}
+
+		config.Set(name, groupConfig)
+	}
+
+	return config
+}
+
+// ansibleToDirectives picks out the variables that map to SSH config.
+// Variables that don't, such as ansible_become or the group's own variables
+// for its playbooks, are left out. A key file path with spaces in is quoted,
+// as ssh would otherwise take it as more than one argument.
+func ansibleToDirectives(vars map[string]any) map[string]any {
+	directives := make(map[string]any)
+
+	for key, value := range vars {
+		directive := ansibleDirective(key)
+		if directive == "" {
+			continue
+		}
+
+		if path, ok := value.(string); ok && directive == "IdentityFile" &&
+			strings.ContainsAny(path, " \t") {
+			value = `"` + path + `"`
+		}
+
+		directives[directive] = value
+	}
+
+	return directives
+}
+
+// ansibleDirective returns the SSH config keyword for one of Ansible's
+// connection variables, including the older ansible_ssh_ forms, or an empty
+// string if it doesn't have one.
+func ansibleDirective(variable string) string {
+	switch variable {
+	case "ansible_host", "ansible_ssh_host":
+		return "HostName"
+	case "ansible_user", "ansible_ssh_user":
+		return "User"
+	case "ansible_port", "ansible_ssh_port":
+		return "Port"
+	case "ansible_ssh_private_key_file", "ansible_private_key_file":
+		return "IdentityFile"
+	default:
+		return ""
+	}
+}
+
+// parseAnsibleINI parses an INI inventory: host lines with optional
+// key=value variables, then [group], [group:vars] and [group:children]
+// sections. Host ranges such as web[01:03] are expanded.
+func parseAnsibleINI(contents []byte) (*ansibleInventory, error) {
+	inventory := &ansibleInventory{
+		groups:   orderedmap.New[string, *ansibleGroup](),
+		hostVars: make(map[string]map[string]any),
+	}
+
+	groupName, section := ansibleUngrouped, ""
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			groupName, section, _ = strings.Cut(line[1:len(line)-1], ":")
+			inventory.group(groupName)
+
+			continue
+		}
+
+		err := inventory.addINILine(groupName, section, line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading inventory: %w", err)
+	}
+
+	return inventory, nil
+}
+
+// addINILine adds a line from a section of an INI inventory to the group.
+func (inv *ansibleInventory) addINILine(groupName, section, line string) error {
+	switch section {
+	case "vars":
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%w: expected key=value: %s", ErrInvalidInventoryLine, line)
+		}
+
+		inv.group(groupName).vars[strings.TrimSpace(key)] = unquote(strings.TrimSpace(value))
+	case "children":
+		group := inv.group(groupName)
+		group.children = append(group.children, line)
+		inv.group(line)
+	case "":
+		return inv.addINIHosts(groupName, line)
+	default:
+		return fmt.Errorf("%w: unknown section type %s", ErrInvalidInventoryLine, section)
+	}
+
+	return nil
+}
+
+// addINIHosts adds the hosts from a host line, expanding any range.
+func (inv *ansibleInventory) addINIHosts(groupName, line string) error {
+	fields, err := splitFields(line)
+	if err != nil {
+		return err
+	}
+
+	vars := make(map[string]any)
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("%w: expected key=value: %s", ErrInvalidInventoryLine, field)
+		}
+
+		vars[key] = value
+	}
+
+	hosts, err := expandHostRange(fields[0])
+	if err != nil {
+		return err
+	}
+
+	for _, host := range hosts {
+		inv.addHost(groupName, host, vars)
+	}
+
+	return nil
+}
+
+// splitFields splits a line on whitespace, except within quotes, which are
+// removed. Within double quotes, a backslash escapes a double quote or
+// another backslash, as it does for a shell.
+func splitFields(line string) ([]string, error) {
+	var (
+		fields  []string
+		builder strings.Builder
+		quote   rune
+		inField bool
+		escaped bool
+	)
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			if r != '"' && r != '\\' {
+				builder.WriteRune('\\')
+			}
+
+			builder.WriteRune(r)
+
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			builder.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inField = r, true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, builder.String())
+				builder.Reset()
+
+				inField = false
+			}
+		default:
+			builder.WriteRune(r)
+
+			inField = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("%w: unterminated quote: %s", ErrInvalidInventoryLine, line)
+	}
+
+	if inField {
+		fields = append(fields, builder.String())
+	}
+
+	return fields, nil
+}
+
+// unquote removes matching quotes from around a value.
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
+
+// expandHostRange expands a host pattern with a numeric range such as
+// web[01:03].example.com, keeping any leading zeros, or an alphabetic range
+// such as db-[a:c]. A host without a range is returned as is.
+func expandHostRange(host string) ([]string, error) {
+	start := strings.IndexByte(host, '[')
+	end := strings.IndexByte(host, ']')
+
+	if start == -1 || end < start {
+		return []string{host}, nil
+	}
+
+	first, last, ok := strings.Cut(host[start+1:end], ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHostRange, host)
+	}
+
+	prefix, suffix := host[:start], host[end+1:]
+
+	// Anything after the range may have a range of its own.
+	suffixes, err := expandHostRange(suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+
+	if firstNumber, err := strconv.Atoi(first); err == nil {
+		lastNumber, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidHostRange, host)
+		}
+
+		for i := firstNumber; i <= lastNumber; i++ {
+			values = append(values, fmt.Sprintf("%0*d", len(first), i))
+		}
+	} else if len(first) == 1 && len(last) == 1 {
+		for c := first[0]; c <= last[0]; c++ {
+			values = append(values, string(c))
+		}
+	} else {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHostRange, host)
+	}
+
+	hosts := make([]string, 0, len(values)*len(suffixes))
+
+	for _, value := range values {
+		for _, suffix := range suffixes {
+			hosts = append(hosts, prefix+value+suffix)
+		}
+	}
+
+	return hosts, nil
+}
+
+// parseAnsibleYAML parses a YAML inventory, which nests groups as children
+// of all.
+func parseAnsibleYAML(contents []byte) (*ansibleInventory, error) {
+	inventory := &ansibleInventory{
+		groups:   orderedmap.New[string, *ansibleGroup](),
+		hostVars: make(map[string]map[string]any),
+	}
+
+	groups := orderedmap.New[string, *ansibleYAMLGroup]()
+
+	err := yaml.Unmarshal(contents, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling yaml: %w", err)
+	}
+
+	for pair := groups.Oldest(); pair != nil; pair = pair.Next() {
+		err = inventory.addYAMLGroup(pair.Key, pair.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return inventory, nil
+}
+
+// addYAMLGroup adds a group from a YAML inventory, and its children.
+// Hosts directly under all are ungrouped, as they are in Ansible.
+func (inv *ansibleInventory) addYAMLGroup(name string, yamlGroup *ansibleYAMLGroup) error {
+	group := inv.group(name)
+
+	if yamlGroup == nil {
+		return nil
+	}
+
+	for key, value := range yamlGroup.Vars {
+		group.vars[key] = value
+	}
+
+	if yamlGroup.Hosts != nil {
+		hostGroup := name
+		if name == ansibleAll {
+			hostGroup = ansibleUngrouped
+		}
+
+		for pair := yamlGroup.Hosts.Oldest(); pair != nil; pair = pair.Next() {
+			hosts, err := expandHostRange(pair.Key)
+			if err != nil {
+				return err
+			}
+
+			for _, host := range hosts {
+				inv.addHost(hostGroup, host, pair.Value)
+			}
+		}
+	}
+
+	if yamlGroup.Children != nil {
+		for pair := yamlGroup.Children.Oldest(); pair != nil; pair = pair.Next() {
+			if name != ansibleAll {
+				group.children = append(group.children, pair.Key)
+			}
+
+			err := inv.addYAMLGroup(pair.Key, pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package sshush
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// FormatINI is Ansible's INI inventory format.
+const FormatINI = "ini"
+
+type (
+	// hostVars is an inventory host's variables, in the order they're
+	// written.
+	hostVars = orderedmap.OrderedMap[string, any]
+
+	// inventoryGroup is a group in a YAML inventory.
+	inventoryGroup struct {
+		Hosts    *orderedmap.OrderedMap[string, *hostVars]       `yaml:"hosts,omitempty"`
+		Children *orderedmap.OrderedMap[string, *inventoryGroup] `yaml:"children,omitempty"`
+	}
+)
+
+// EncodeAnsibleInventory writes the resolved model to w as an Ansible
+// inventory, in FormatINI or FormatYAML. Each group becomes an inventory
+// group, and a group that others extend has them as its children.
+// HostName, User, Port and IdentityFile become ansible_host, ansible_user,
+// ansible_port and ansible_ssh_private_key_file, and any other directives
+// are passed to ssh through ansible_ssh_common_args. Wildcard hosts can't be
+// inventory hosts, so they're left out, as is the global config.
+func EncodeAnsibleInventory(w io.Writer, config *Config, format string) error {
+	switch format {
+	case FormatINI:
+		return encodeAnsibleINI(w, config)
+	case FormatYAML:
+		return encodeAnsibleYAML(w, config)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+// encodeAnsibleINI writes a section per group with its hosts, followed by a
+// children section for any group that's extended.
+func encodeAnsibleINI(w io.Writer, config *Config) error {
+	var builder strings.Builder
+
+	children := inventoryChildren(config)
+
+	for _, group := range config.Groups {
+		builder.WriteString("[" + group.Name + "]\n")
+
+		for _, host := range group.Hosts {
+			if host.Pattern {
+				continue
+			}
+
+			builder.WriteString(host.Alias)
+
+			vars := ansibleHostVars(host)
+			for pair := vars.Oldest(); pair != nil; pair = pair.Next() {
+				builder.WriteString(" " + pair.Key + "=" + quote(fmt.Sprint(pair.Value)))
+			}
+
+			builder.WriteString("\n")
+		}
+
+		if len(children[group.Name]) > 0 {
+			builder.WriteString("\n[" + group.Name + ":children]\n")
+
+			for _, child := range children[group.Name] {
+				builder.WriteString(child + "\n")
+			}
+		}
+
+		builder.WriteString("\n")
+	}
+
+	_, err := io.WriteString(w, strings.TrimSuffix(builder.String(), "\n"))
+	if err != nil {
+		return fmt.Errorf("writing inventory: %w", err)
+	}
+
+	return nil
+}
+
+// encodeAnsibleYAML writes the groups nested under all, with each group that
+// extends another nested under it as a child.
+func encodeAnsibleYAML(w io.Writer, config *Config) error {
+	children := inventoryChildren(config)
+	groups := make(map[string]Group, len(config.Groups))
+
+	for _, group := range config.Groups {
+		groups[group.Name] = group
+	}
+
+	var build func(group Group) *inventoryGroup
+
+	build = func(group Group) *inventoryGroup {
+		inventory := &inventoryGroup{}
+
+		for _, host := range group.Hosts {
+			if host.Pattern {
+				continue
+			}
+
+			if inventory.Hosts == nil {
+				inventory.Hosts = orderedmap.New[string, *hostVars]()
+			}
+
+			inventory.Hosts.Set(host.Alias, ansibleHostVars(host))
+		}
+
+		for _, child := range children[group.Name] {
+			if inventory.Children == nil {
+				inventory.Children = orderedmap.New[string, *inventoryGroup]()
+			}
+
+			inventory.Children.Set(child, build(groups[child]))
+		}
+
+		return inventory
+	}
+
+	all := &inventoryGroup{Children: orderedmap.New[string, *inventoryGroup]()}
+
+	for _, group := range config.Groups {
+		if !hasInventoryParent(group, children) {
+			all.Children.Set(group.Name, build(group))
+		}
+	}
+
+	inventory := orderedmap.New[string, *inventoryGroup]()
+	inventory.Set(ansibleAll, all)
+
+	return encode(w, inventory, FormatYAML)
+}
+
+// inventoryChildren returns the groups that extend each group. Extends that
+// would make a group its own descendant are ignored, so that circular
+// Extends don't nest forever.
+func inventoryChildren(config *Config) map[string][]string {
+	parents := make(map[string]string)
+
+	for _, group := range config.Groups {
+		if group.Extends != "" && slices.ContainsFunc(config.Groups, func(g Group) bool {
+			return g.Name == group.Extends
+		}) {
+			parents[group.Name] = group.Extends
+		}
+	}
+
+	children := make(map[string][]string)
+
+	for _, group := range config.Groups {
+		parent, ok := parents[group.Name]
+		if !ok || isAncestor(group.Name, parent, parents) {
+			delete(parents, group.Name)
+
+			continue
+		}
+
+		children[parent] = append(children[parent], group.Name)
+	}
+
+	return children
+}
+
+// isAncestor reports whether group is found by following parents up from
+// start.
+func isAncestor(group, start string, parents map[string]string) bool {
+	for ancestor, ok := start, true; ok; ancestor, ok = parents[ancestor] {
+		if ancestor == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasInventoryParent reports whether the group is a child of another.
+func hasInventoryParent(group Group, children map[string][]string) bool {
+	for _, siblings := range children {
+		if slices.Contains(siblings, group.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ansibleHostVars returns the Ansible connection variables for a host.
+func ansibleHostVars(host Host) *hostVars {
+	vars := orderedmap.New[string, any]()
+
+	var commonArgs []string
+
+	for _, directive := range host.Directives {
+		variable := ansibleVariable(directive.Key)
+
+		for i, value := range directive.Values {
+			if variable == "" || i > 0 {
+				commonArgs = append(commonArgs, "-o "+quote(directive.Key+"="+value))
+
+				continue
+			}
+
+			// A value with spaces in is double quoted for ssh, but Ansible
+			// takes it as it is.
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+
+			if port, err := strconv.Atoi(value); err == nil && directive.Key == "Port" {
+				vars.Set(variable, port)
+			} else {
+				vars.Set(variable, value)
+			}
+		}
+	}
+
+	if len(commonArgs) > 0 {
+		vars.Set("ansible_ssh_common_args", strings.Join(commonArgs, " "))
+	}
+
+	return vars
+}
+
+// ansibleVariable returns the Ansible connection variable for an SSH config
+// keyword, or an empty string if there isn't one. It's the reverse of
+// ansibleDirective.
+func ansibleVariable(directive string) string {
+	switch directive {
+	case "HostName":
+		return "ansible_host"
+	case "User":
+		return "ansible_user"
+	case "Port":
+		return "ansible_port"
+	case "IdentityFile":
+		return "ansible_ssh_private_key_file"
+	default:
+		return ""
+	}
+}
+
+// quote quotes a value containing spaces or quotes for an INI inventory, or
+// for ansible_ssh_common_args, both of which Ansible splits as a shell would.
+// Single quotes are used where they can be, otherwise double quotes, with
+// any double quotes and backslashes in the value escaped.
+func quote(value string) string {
+	if !strings.ContainsAny(value, " \t'\"\\") {
+		return value
+	}
+
+	if !strings.Contains(value, "'") {
+		return "'" + value + "'"
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
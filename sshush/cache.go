@@ -0,0 +1,72 @@
+package sshush
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// cacheFilePermission is the permission of cached files, which may well
+	// describe private infrastructure.
+	cacheFilePermission = 0o600
+	// cacheDirPermission is the permission of the cache directory.
+	cacheDirPermission = 0o700
+)
+
+// cacheFile returns the path of the file to cache something in, named by
+// its kind and a hash of what identifies it.
+func (p *Parser) cacheFile(kind string, key ...string) (string, error) {
+	dir := p.CacheDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("getting cache dir: %w", err)
+		}
+
+		dir = filepath.Join(cacheDir, "sshush")
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+
+	return filepath.Join(dir, kind+"-"+hex.EncodeToString(sum[:])), nil
+}
+
+// cacheFS returns the filesystem the cache is kept in.
+func (p *Parser) cacheFS() FileSystem {
+	if p.CacheFS != nil {
+		return p.CacheFS
+	}
+
+	return OSFileSystem{}
+}
+
+// writeCacheFile writes the cached file, creating the cache directory if
+// the filesystem has directories to create. Nothing is written on a dry run.
+func (p *Parser) writeCacheFile(name string, contents []byte) error {
+	if p.DryRun {
+		return nil
+	}
+
+	fsys := p.cacheFS()
+
+	if dirFS, ok := fsys.(interface {
+		MkdirAll(name string, perm fs.FileMode) error
+	}); ok {
+		err := dirFS.MkdirAll(filepath.Dir(name), cacheDirPermission)
+		if err != nil {
+			return fmt.Errorf("creating cache dir: %w", err)
+		}
+	}
+
+	err := fsys.WriteFile(name, contents, cacheFilePermission)
+	if err != nil {
+		return fmt.Errorf("writing cache file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package sshush
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// certificateKey is the config key a certificate is declared under, on
+	// the defaults, a group or a host. It's written as CertificateFile.
+	certificateKey = "Certificate"
+	// certificateSuffix is appended to an IdentityFile to name its
+	// certificate, as ssh-keygen -s does, when Certificate is true.
+	certificateSuffix = "-cert.pub"
+	// publicKeySuffix is appended to an IdentityFile to name its public key.
+	publicKeySuffix = ".pub"
+)
+
+var (
+	ErrCertificateWithoutIdentity = errors.New("certificate without an IdentityFile")
+	ErrCertificateMismatch        = errors.New("certificate doesn't match its IdentityFile")
+	ErrInvalidCertificate         = errors.New("invalid certificate")
+)
+
+// certificateDirectives replaces a Certificate directive with CertificateFile,
+// placed just after the IdentityFile it pairs with. Certificate is either
+// true, for each IdentityFile's -cert.pub, or a certificate per IdentityFile
+// in the same order. False drops it, so a host can opt out of its group's.
+//
+// Each certificate that can be read is checked offline: it must be a user
+// certificate for the IdentityFile's public key, and a warning is logged if
+// it has expired, isn't valid yet or doesn't list the host's User.
+func (p *Parser) certificateDirectives(name string, directives []Directive) ([]Directive, error) {
+	certIndex := slices.IndexFunc(directives, func(d Directive) bool {
+		return d.Key == certificateKey
+	})
+	if certIndex == -1 {
+		return directives, nil
+	}
+
+	cert := directives[certIndex]
+	directives = slices.Delete(slices.Clone(directives), certIndex, certIndex+1)
+
+	if len(cert.Values) == 1 && (cert.Values[0] == "false" || cert.Values[0] == "no") {
+		return directives, nil
+	}
+
+	identityIndex := slices.IndexFunc(directives, func(d Directive) bool {
+		return d.Key == "IdentityFile"
+	})
+	if identityIndex == -1 {
+		return nil, fmt.Errorf("%w: %s", ErrCertificateWithoutIdentity, name)
+	}
+
+	identities := directives[identityIndex].Values
+	certFiles := cert.Values
+
+	if len(certFiles) == 1 && (certFiles[0] == "true" || certFiles[0] == "yes") {
+		certFiles = make([]string, 0, len(identities))
+
+		for _, identity := range identities {
+			certFiles = append(certFiles, identity+certificateSuffix)
+		}
+	}
+
+	if len(certFiles) != len(identities) {
+		return nil, fmt.Errorf(
+			"%w: %s has %d certificates for %d identity files",
+			ErrCertificateMismatch, name, len(certFiles), len(identities),
+		)
+	}
+
+	user := ""
+
+	userIndex := slices.IndexFunc(directives, func(d Directive) bool {
+		return d.Key == "User"
+	})
+	if userIndex != -1 {
+		user = directives[userIndex].Values[0]
+	}
+
+	for i, certFile := range certFiles {
+		err := p.checkCertificate(name, identities[i], certFile, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return slices.Insert(directives, identityIndex+1, Directive{
+		Key:    "CertificateFile",
+		Values: certFiles,
+		Origin: cert.Origin,
+	}), nil
+}
+
+// checkCertificate checks a certificate against its identity file and the
+// host's user. Each pairing is only checked once per run, so a group's
+// certificate isn't reported for every host in it.
+func (p *Parser) checkCertificate(name, identity, certFile, user string) error {
+	checked := identity + "\x00" + certFile + "\x00" + user
+	if p.certificates[checked] {
+		return nil
+	}
+
+	if p.certificates == nil {
+		p.certificates = make(map[string]bool)
+	}
+
+	p.certificates[checked] = true
+
+	// Tokens and environment variables are expanded by ssh at connect time.
+	if strings.ContainsAny(certFile+identity, "%$") {
+		return nil
+	}
+
+	contents, err := fs.ReadFile(p.fs(), expandHome(certFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		p.logger().Warn("certificate not found", "host", name, "certificate", certFile)
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidCertificate, certFile, err)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidCertificate, certFile, err)
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return fmt.Errorf("%w: %s is not a user certificate", ErrInvalidCertificate, certFile)
+	}
+
+	err = p.checkCertificateKey(identity, certFile, cert)
+	if err != nil {
+		return err
+	}
+
+	p.checkCertificateValidity(name, certFile, cert, user)
+
+	return nil
+}
+
+// checkCertificateKey checks the certificate is for the identity's public key,
+// if there's a .pub alongside it.
+func (p *Parser) checkCertificateKey(identity, certFile string, cert *ssh.Certificate) error {
+	contents, err := fs.ReadFile(p.fs(), expandHome(identity)+publicKeySuffix)
+	if err != nil {
+		return nil //nolint:nilerr // Without the public key there's nothing to compare.
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return fmt.Errorf("%w: %s%s: %w", ErrInvalidCertificate, identity, publicKeySuffix, err)
+	}
+
+	if !bytes.Equal(publicKey.Marshal(), cert.Key.Marshal()) {
+		return fmt.Errorf("%w: %s is not for %s", ErrCertificateMismatch, certFile, identity)
+	}
+
+	return nil
+}
+
+// checkCertificateValidity warns about a certificate that won't be accepted,
+// because of when it's valid or who it's valid for.
+func (p *Parser) checkCertificateValidity(
+	name, certFile string,
+	cert *ssh.Certificate,
+	user string,
+) {
+	now := p.now()
+
+	//nolint:gosec // Certificate times are seconds since the epoch, well within int64.
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	if now.Before(validAfter) {
+		p.logger().Warn(
+			"certificate is not yet valid",
+			"host", name, "certificate", certFile, "valid_after", validAfter,
+		)
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		//nolint:gosec // Certificate times are seconds since the epoch, well within int64.
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if !now.Before(validBefore) {
+			p.logger().Warn(
+				"certificate has expired",
+				"host", name, "certificate", certFile, "valid_before", validBefore,
+			)
+		}
+	}
+
+	// A certificate without principals is valid for any user.
+	if user != "" && len(cert.ValidPrincipals) > 0 && !slices.Contains(cert.ValidPrincipals, user) {
+		p.logger().Warn(
+			"certificate principals don't include the user",
+			"host", name, "certificate", certFile, "user", user,
+			"principals", cert.ValidPrincipals,
+		)
+	}
+}
+
+// expandHome expands a leading ~ to the home directory, as ssh does for
+// IdentityFile and CertificateFile.
+func expandHome(name string) string {
+	if name != "~" && !strings.HasPrefix(name, "~/") {
+		return name
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return name
+	}
+
+	return filepath.Join(homeDir, name[1:])
+}
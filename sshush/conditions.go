@@ -0,0 +1,211 @@
+package sshush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SourceConditions must all be met for a source to be loaded, so that a
+// shared directory of sources can hold some that only apply to certain
+// machines.
+type SourceConditions struct {
+	// Hostname is a glob the local hostname must match, e.g. "work-*".
+	Hostname string `yaml:"hostname,omitempty"`
+	// Env is the name of an environment variable that must be set.
+	Env string `yaml:"env,omitempty"`
+	// FileExists is a path that must exist. A relative path is relative to
+	// the source and ~ is the home directory.
+	FileExists string `yaml:"file_exists,omitempty"`
+}
+
+var (
+	ErrInvalidCondition       = errors.New("invalid condition")
+	ErrRequiredSourceNotFound = errors.New("required source not loaded")
+)
+
+// skipReason returns why the source shouldn't be loaded, according to its
+// front matter, or an empty string if it should.
+func (p *Parser) skipReason(
+	ctx context.Context,
+	source string,
+	fm *SourceFrontMatter,
+) (string, error) {
+	if fm.Enabled != nil && !*fm.Enabled {
+		return "disabled", nil
+	}
+
+	if fm.When.Hostname != "" {
+		hostname, err := p.hostname()
+		if err != nil {
+			return "", fmt.Errorf("getting hostname: %w", err)
+		}
+
+		matched, err := path.Match(fm.When.Hostname, hostname)
+		if err != nil {
+			return "", fmt.Errorf(
+				"%w: %s hostname %s: %w",
+				ErrInvalidCondition,
+				source,
+				fm.When.Hostname,
+				err,
+			)
+		}
+
+		if !matched {
+			return fmt.Sprintf("hostname %s doesn't match %s", hostname, fm.When.Hostname), nil
+		}
+	}
+
+	if fm.When.Env != "" {
+		if _, ok := p.lookupEnv()(fm.When.Env); !ok {
+			return "environment variable " + fm.When.Env + " isn't set", nil
+		}
+	}
+
+	if fm.When.FileExists != "" {
+		name, err := relativeToSource(source, fm.When.FileExists)
+		if err != nil {
+			return "", err
+		}
+
+		fsys, fileName, err := p.sourceFS(ctx, name)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = fs.Stat(fsys, fileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			return name + " doesn't exist", nil
+		}
+
+		if err != nil {
+			return "", fmt.Errorf(
+				"%w: %s file_exists %s: %w",
+				ErrInvalidCondition,
+				source,
+				name,
+				err,
+			)
+		}
+	}
+
+	return "", nil
+}
+
+// checkRequires checks that every source required by another has been
+// loaded too.
+func (p *Parser) checkRequires(discovered []discoveredSource) error {
+	loaded := make(map[string]bool, len(discovered))
+
+	for _, source := range discovered {
+		loaded[cleanSource(source.name)] = true
+	}
+
+	for _, source := range discovered {
+		for _, required := range source.frontMatter.Requires {
+			name, err := relativeToSource(source.name, required)
+			if err != nil {
+				return err
+			}
+
+			if !loaded[name] {
+				return fmt.Errorf(
+					"%w: %s requires %s",
+					ErrRequiredSourceNotFound,
+					source.name,
+					name,
+				)
+			}
+
+			if p.Verbose {
+				p.logger().Info(source.name + " requires " + name + ", which is loaded")
+			}
+		}
+	}
+
+	return nil
+}
+
+// relativeToSource resolves a path from a source's front matter, expanding ~
+// to the home directory and making a relative path relative to the source's
+// directory. A relative path from a git source is another git source in the
+// same repository at the same ref.
+func relativeToSource(source, name string) (string, error) {
+	if name == "~" || strings.HasPrefix(name, "~/") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("getting home dir: %w", err)
+		}
+
+		name = filepath.Join(homeDir, name[1:])
+	}
+
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name), nil
+	}
+
+	if prefix, _ := SplitSource(source); prefix == GitSourcePrefix {
+		g, err := parseGitSource(source)
+		if err != nil {
+			return "", err
+		}
+
+		return g.withPath(path.Join(path.Dir(g.path), name)).String(), nil
+	}
+
+	// Stdin, commands and URLs aren't files, so they're relative to the
+	// working directory.
+	dir := "."
+	if prefix, path := SplitSource(source); isFileSource(prefix, path) {
+		dir = filepath.Dir(path)
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// cleanSource cleans a source so that sources can be compared. Git sources
+// and URLs are left alone, as cleaning would remove their double slashes.
+func cleanSource(source string) string {
+	if prefix, _ := SplitSource(source); prefix == GitSourcePrefix || IsURLSource(source) {
+		return source
+	}
+
+	return filepath.Clean(source)
+}
+
+// sourceFS returns the filesystem a path from a source's front matter, as
+// resolved by relativeToSource, is in, along with its name there. Paths from
+// git sources are in the repository and anything else is in FS.
+func (p *Parser) sourceFS(ctx context.Context, name string) (fs.FS, string, error) {
+	if prefix, _ := SplitSource(name); prefix == GitSourcePrefix {
+		g, err := parseGitSource(name)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return g.fs(ctx), g.path, nil
+	}
+
+	return p.fs(), name, nil
+}
+
+// isFileSource reports whether a source, split into its prefix and path, is
+// read from a file.
+func isFileSource(prefix, path string) bool {
+	return prefix != ExecSourcePrefix && path != StdinSource && !IsURLSource(path)
+}
+
+// hostname returns the local hostname.
+func (p *Parser) hostname() (string, error) {
+	if p.Hostname != nil {
+		return p.Hostname()
+	}
+
+	return os.Hostname() //nolint:wrapcheck // Wrapped by the caller.
+}
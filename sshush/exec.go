@@ -0,0 +1,145 @@
+package sshush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// ExecSourcePrefix marks a source as a command to run rather than a file
+	// to read, e.g. "exec:./inventory.sh --env prod". Its output is read as
+	// an sshush source, in YAML or JSON.
+	ExecSourcePrefix = "exec:"
+
+	// DefaultExecTimeout is how long a command source may run for, unless
+	// ExecTimeout is set.
+	DefaultExecTimeout = 30 * time.Second
+)
+
+var (
+	ErrRunningCommand = errors.New("failed to run command")
+	ErrEmptyCommand   = errors.New("empty command")
+)
+
+// runCommandSource runs a command source and returns its output. If
+// ExecCacheTTL is set, output from a previous run within the TTL is used
+// rather than running the command again.
+func (p *Parser) runCommandSource(ctx context.Context, command string) ([]byte, error) {
+	cacheFile, err := p.execCacheFile(command)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheFile != "" {
+		if contents, ok := p.cachedOutput(cacheFile); ok {
+			if p.Verbose {
+				p.logger().Info("Using cached output of "+command, "cache", cacheFile)
+			}
+
+			return contents, nil
+		}
+	}
+
+	output, err := p.runCommand(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheFile != "" {
+		err = p.writeCacheFile(cacheFile, output)
+		if err != nil {
+			p.logger().Warn("caching command output", "command", command, "error", err)
+		}
+	}
+
+	return output, nil
+}
+
+// runCommand runs the command, without a shell, and returns its stdout.
+// Whatever it wrote to stderr is included in the error if it fails.
+func (p *Parser) runCommand(ctx context.Context, command string) ([]byte, error) {
+	args, err := splitFields(command)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrRunningCommand, command, err)
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%w: %w", ErrRunningCommand, ErrEmptyCommand)
+	}
+
+	timeout := p.ExecTimeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	//nolint:gosec // Running the configured command is the point.
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = p.WorkingDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if p.Verbose {
+		p.logger().Info("Running " + command)
+	}
+
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %s: timed out after %s", ErrRunningCommand, command, timeout)
+	}
+
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%w: %s: %w: %s", ErrRunningCommand, command, err, message)
+		}
+
+		return nil, fmt.Errorf("%w: %s: %w", ErrRunningCommand, command, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// execCacheFile returns the file the command's output is cached in, or ""
+// if caching is off. A relative command is a different command in another
+// directory, so output is only cached if the working directory is known.
+func (p *Parser) execCacheFile(command string) (string, error) {
+	if p.ExecCacheTTL <= 0 || p.WorkingDir == "" {
+		return "", nil
+	}
+
+	return p.cacheFile("exec", p.WorkingDir, command)
+}
+
+// cachedOutput returns the cached output, if it was written within the TTL.
+func (p *Parser) cachedOutput(cacheFile string) ([]byte, bool) {
+	info, err := fs.Stat(p.cacheFS(), cacheFile)
+	if err != nil || p.now().Sub(info.ModTime()) >= p.ExecCacheTTL {
+		return nil, false
+	}
+
+	contents, err := p.cacheFS().ReadFile(cacheFile)
+	if err != nil {
+		return nil, false
+	}
+
+	return contents, true
+}
+
+// now returns the current time.
+func (p *Parser) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+
+	return time.Now()
+}
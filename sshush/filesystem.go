@@ -0,0 +1,39 @@
+package sshush
+
+import (
+	"io/fs"
+	"os"
+)
+
+type (
+	// FileSystem is what sshush needs to read and write files. Reading follows
+	// io/fs, so that an fs.FS can stand in for it in tests.
+	FileSystem interface {
+		fs.ReadFileFS
+		WriteFile(name string, data []byte, perm fs.FileMode) error
+	}
+
+	// OSFileSystem is a FileSystem backed by the os package. Unlike os.DirFS
+	// it accepts any path the os package does, including absolute paths.
+	OSFileSystem struct{}
+)
+
+//nolint:wrapcheck // This is a thin adapter, errors are wrapped by the caller.
+func (OSFileSystem) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+//nolint:wrapcheck // This is a thin adapter, errors are wrapped by the caller.
+func (OSFileSystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+//nolint:wrapcheck // This is a thin adapter, errors are wrapped by the caller.
+func (OSFileSystem) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+//nolint:wrapcheck // This is a thin adapter, errors are wrapped by the caller.
+func (OSFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
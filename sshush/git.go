@@ -0,0 +1,289 @@
+package sshush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// GitSourcePrefix marks a source as a file in a local git repository at
+	// a particular ref, read without checking it out. The repository and the
+	// path within it are separated by //, and the ref is a query parameter,
+	// e.g. "git+file:///srv/ssh-configs.git//groups/*.yml?ref=v3". The ref
+	// defaults to HEAD.
+	GitSourcePrefix = "git+file://"
+
+	// gitPathSeparator separates the repository from the path within it.
+	gitPathSeparator = "//"
+	// gitDefaultRef is the ref used when a source doesn't name one.
+	gitDefaultRef = "HEAD"
+
+	// gitFileMode and gitDirMode are the permissions of what's read from git,
+	// which can't be written to.
+	gitFileMode = 0o444
+	gitDirMode  = 0o555
+)
+
+type (
+	// gitSource is a source read from a git repository.
+	gitSource struct {
+		repo string
+		path string
+		ref  string
+	}
+
+	// gitFS reads the files of a git repository at a ref, using the git
+	// command, so that nothing needs to be checked out. The git commands are
+	// killed if ctx is cancelled.
+	gitFS struct {
+		//nolint:containedctx // fs.FS methods can't take a context.
+		ctx  context.Context
+		repo string
+		ref  string
+	}
+
+	// gitFile is a file read from a git repository.
+	gitFile struct {
+		*bytes.Reader
+
+		info gitFileInfo
+	}
+
+	// gitFileInfo describes a file or directory in a git repository.
+	gitFileInfo struct {
+		name string
+		size int64
+		dir  bool
+	}
+)
+
+var (
+	ErrInvalidGitSource = errors.New("invalid git source")
+	ErrReadingGit       = errors.New("failed to read from git")
+)
+
+// parseGitSource parses a source with the GitSourcePrefix.
+func parseGitSource(source string) (gitSource, error) {
+	rest, ok := strings.CutPrefix(source, GitSourcePrefix)
+	if !ok {
+		return gitSource{}, fmt.Errorf("%w: %s", ErrInvalidGitSource, source)
+	}
+
+	rest, query, _ := strings.Cut(rest, "?")
+
+	repo, filePath, ok := strings.Cut(rest, gitPathSeparator)
+	if !ok || repo == "" || filePath == "" {
+		return gitSource{}, fmt.Errorf(
+			"%w: %s: expected %s<repository>//<path>",
+			ErrInvalidGitSource,
+			source,
+			GitSourcePrefix,
+		)
+	}
+
+	ref := gitDefaultRef
+
+	for _, param := range strings.Split(query, "&") {
+		if value, ok := strings.CutPrefix(param, "ref="); ok && value != "" {
+			ref = value
+		}
+	}
+
+	// git would take a ref starting with - as an option.
+	if strings.HasPrefix(ref, "-") {
+		return gitSource{}, fmt.Errorf("%w: %s: invalid ref %s", ErrInvalidGitSource, source, ref)
+	}
+
+	return gitSource{repo: repo, path: path.Clean(filePath), ref: ref}, nil
+}
+
+// String returns the source in the same form it's parsed from.
+func (g gitSource) String() string {
+	return GitSourcePrefix + g.repo + gitPathSeparator + g.path + "?ref=" + g.ref
+}
+
+// withPath returns the source for another path in the same repository and
+// ref.
+func (g gitSource) withPath(filePath string) gitSource {
+	g.path = path.Clean(filePath)
+
+	return g
+}
+
+// fs returns the repository's files at the source's ref.
+func (g gitSource) fs(ctx context.Context) gitFS {
+	return gitFS{ctx: ctx, repo: g.repo, ref: g.ref}
+}
+
+// ExpandGitSource expands a git source whose path is a glob into a source
+// for each matching file, in order. A source without a glob is returned as
+// it is.
+func ExpandGitSource(ctx context.Context, source string) ([]string, error) {
+	g, err := parseGitSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.ContainsAny(g.path, `*?[\`) {
+		return []string{g.String()}, nil
+	}
+
+	matches, err := fs.Glob(g.fs(ctx), g.path)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", source, err)
+	}
+
+	sources := make([]string, 0, len(matches))
+	for _, match := range matches {
+		sources = append(sources, g.withPath(match).String())
+	}
+
+	return sources, nil
+}
+
+// readGitSource reads a git source's file.
+func readGitSource(ctx context.Context, source string) ([]byte, error) {
+	g, err := parseGitSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.fs(ctx).ReadFile(g.path)
+}
+
+// Open opens the named file. Directories can't be opened, but can be
+// listed with Glob.
+func (f gitFS) Open(name string) (fs.File, error) {
+	contents, err := f.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitFile{
+		Reader: bytes.NewReader(contents),
+		info:   gitFileInfo{name: path.Base(name), size: int64(len(contents))},
+	}, nil
+}
+
+// ReadFile reads the named file at the ref.
+func (f gitFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	contents, err := f.git("cat-file", "blob", f.ref+":"+name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return contents, nil
+}
+
+// Stat describes the named file or directory at the ref.
+func (f gitFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	objectType, err := f.git("cat-file", "-t", f.ref+":"+name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return gitFileInfo{
+		name: path.Base(name),
+		dir:  strings.TrimSpace(string(objectType)) == "tree",
+	}, nil
+}
+
+// Glob returns the files at the ref matching the pattern, sorted.
+func (f gitFS) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("matching %s: %w", pattern, err)
+	}
+
+	listing, err := f.git("ls-tree", "-r", "-z", "--name-only", "--full-tree", f.ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+
+	for _, name := range strings.Split(string(listing), "\x00") {
+		if matched, _ := path.Match(pattern, name); matched && name != "" {
+			matches = append(matches, name)
+		}
+	}
+
+	slices.Sort(matches)
+
+	return matches, nil
+}
+
+// git runs a git command against the repository and returns its output.
+// Whatever git wrote to stderr is included in the error if it fails.
+func (f gitFS) git(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(f.ctx, "git", slices.Concat([]string{"-C", f.repo}, args)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%w: %s at %s: %w: %s",
+			ErrReadingGit,
+			f.repo,
+			f.ref,
+			err,
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (f *gitFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *gitFile) Close() error {
+	return nil
+}
+
+func (i gitFileInfo) Name() string {
+	return i.name
+}
+
+func (i gitFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i gitFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | gitDirMode
+	}
+
+	return gitFileMode
+}
+
+func (i gitFileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i gitFileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i gitFileInfo) Sys() any {
+	return nil
+}
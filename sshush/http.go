@@ -0,0 +1,241 @@
+package sshush
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// checksumPrefix starts a URL source's fragment to pin its contents to a
+	// SHA-256 checksum, e.g. https://example.com/ssh.yml#sha256=<hex>.
+	checksumPrefix = "sha256="
+
+	// defaultHTTPTimeout is how long a URL source may take to download,
+	// unless HTTPClient is set.
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+type (
+	// httpCacheEntry is what's kept alongside a URL source's cached
+	// contents, to make conditional requests with.
+	httpCacheEntry struct {
+		URL          string `json:"url"`
+		ETag         string `json:"etag,omitempty"`
+		LastModified string `json:"last_modified,omitempty"`
+	}
+
+	// unavailableError is a failure to download a source that the cache can
+	// stand in for.
+	unavailableError struct {
+		err error
+	}
+)
+
+var (
+	ErrFetchingSource   = errors.New("failed to fetch source")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrInvalidChecksum  = errors.New("invalid checksum")
+)
+
+// IsURLSource reports whether the source is an http or https URL rather
+// than a path.
+func IsURLSource(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+// fetchURLSource downloads a URL source. The contents are cached, and sent
+// again with the ETag and Last-Modified, so that an unchanged source isn't
+// downloaded again. If the server can't be reached, or has an error of its
+// own, the cached contents are used with a warning.
+func (p *Parser) fetchURLSource(ctx context.Context, source string) ([]byte, error) {
+	sourceURL, checksum, err := splitChecksum(source)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheFile, err := p.cacheFile("http", sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, cached := p.readHTTPCache(cacheFile, sourceURL)
+
+	contents, fresh, err := p.download(ctx, sourceURL, entry, cached)
+
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) && cached != nil {
+		p.logger().Warn("using cached source", "source", sourceURL, "error", unavailable.err)
+
+		contents, err = cached, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The checksum is verified before caching, so a bad download never
+	// replaces a good one.
+	err = verifyChecksum(contents, checksum)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, sourceURL)
+	}
+
+	if fresh != nil {
+		p.writeHTTPCache(cacheFile, *fresh, contents)
+	}
+
+	return contents, nil
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+// download fetches the URL, making a conditional request if there's a
+// cached copy. Along with the contents, it returns the cache entry for them
+// if they were downloaded rather than being the cached copy.
+func (p *Parser) download(
+	ctx context.Context,
+	sourceURL string,
+	entry httpCacheEntry,
+	cached []byte,
+) ([]byte, *httpCacheEntry, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %w", ErrFetchingSource, sourceURL, err)
+	}
+
+	if cached != nil {
+		if entry.ETag != "" {
+			request.Header.Set("If-None-Match", entry.ETag)
+		}
+
+		if entry.LastModified != "" {
+			request.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	response, err := p.httpClient().Do(request)
+	if err != nil {
+		return nil, nil, &unavailableError{fmt.Errorf("%w: %w", ErrFetchingSource, err)}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotModified && cached != nil:
+		if p.Verbose {
+			p.logger().Info("Not modified: " + sourceURL)
+		}
+
+		return cached, nil, nil
+	case response.StatusCode >= http.StatusInternalServerError:
+		return nil, nil, &unavailableError{
+			fmt.Errorf("%w: %s: %s", ErrFetchingSource, sourceURL, response.Status),
+		}
+	case response.StatusCode != http.StatusOK:
+		return nil, nil, fmt.Errorf("%w: %s: %s", ErrFetchingSource, sourceURL, response.Status)
+	}
+
+	contents, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, &unavailableError{
+			fmt.Errorf("%w: %s: %w", ErrFetchingSource, sourceURL, err),
+		}
+	}
+
+	return contents, &httpCacheEntry{
+		URL:          sourceURL,
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// splitChecksum removes the checksum, if there is one, from the source's
+// fragment.
+func splitChecksum(source string) (string, string, error) {
+	sourceURL, fragment, _ := strings.Cut(source, "#")
+	if fragment == "" {
+		return sourceURL, "", nil
+	}
+
+	checksum, ok := strings.CutPrefix(fragment, checksumPrefix)
+	if !ok {
+		return "", "", fmt.Errorf(
+			"%w: %s: expected #%s", ErrInvalidChecksum, source, checksumPrefix,
+		)
+	}
+
+	return sourceURL, strings.ToLower(checksum), nil
+}
+
+// verifyChecksum checks the contents against the pinned checksum, if any.
+func verifyChecksum(contents []byte, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256(contents)
+
+	if actual := hex.EncodeToString(sum[:]); actual != checksum {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, checksum, actual)
+	}
+
+	return nil
+}
+
+// readHTTPCache returns the cached contents of the URL and what's needed to
+// make a conditional request for it, or nil contents if it isn't cached.
+func (p *Parser) readHTTPCache(cacheFile, sourceURL string) (httpCacheEntry, []byte) {
+	var entry httpCacheEntry
+
+	metadata, err := p.cacheFS().ReadFile(cacheFile + ".json")
+	if err != nil || json.Unmarshal(metadata, &entry) != nil || entry.URL != sourceURL {
+		return httpCacheEntry{}, nil
+	}
+
+	contents, err := p.cacheFS().ReadFile(cacheFile)
+	if err != nil {
+		return httpCacheEntry{}, nil
+	}
+
+	return entry, contents
+}
+
+// writeHTTPCache caches the contents of the URL. Failing to is only a
+// warning, as the source itself was downloaded.
+func (p *Parser) writeHTTPCache(cacheFile string, entry httpCacheEntry, contents []byte) {
+	err := p.writeCacheFile(cacheFile, contents)
+	if err == nil {
+		var metadata []byte
+
+		metadata, err = json.Marshal(entry)
+		if err == nil {
+			err = p.writeCacheFile(cacheFile+".json", metadata)
+		}
+	}
+
+	if err != nil {
+		p.logger().Warn("caching source", "source", entry.URL, "error", err)
+	}
+}
+
+// httpClient returns the client to download URL sources with.
+func (p *Parser) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+
+	return &http.Client{Timeout: defaultHTTPTimeout}
+}
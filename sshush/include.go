@@ -0,0 +1,230 @@
+package sshush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// includeBlock is the top level key a source can list its includes under, as
+// an alternative to its front matter.
+const includeBlock = "include"
+
+type (
+	// discoveredSource is a source, explicit or included, with its front
+	// matter.
+	discoveredSource struct {
+		name        string
+		frontMatter *SourceFrontMatter
+	}
+)
+
+var (
+	ErrIncludeCycle            = errors.New("include cycle")
+	ErrIncludeNotFound         = errors.New("included file not found")
+	ErrIncludeNotListOfStrings = errors.New("include is not a list of strings")
+	ErrIncludeIsGroup          = errors.New("include is reserved for includes, not a group")
+)
+
+// discoverSources returns the sources along with every file they include,
+// recursively. Included files come before the source that included them, so
+// that the including source can override them. A file is only returned once,
+// however many times it's included.
+// The sources, and then each source's includes, are parsed concurrently and
+// cached for Load.
+func (p *Parser) discoverSources(
+	ctx context.Context,
+	sources SSHConfigSources,
+) ([]discoveredSource, error) {
+	var discovered []discoveredSource
+
+	seen := make(map[string]bool)
+
+	err := p.parseSources(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range sources {
+		err = p.discover(ctx, source, nil, seen, &discovered)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.checkRequires(discovered)
+	if err != nil {
+		return nil, err
+	}
+
+	return discovered, nil
+}
+
+// discover adds the source, after anything it includes, to discovered.
+// including is the chain of sources that led to this one, for detecting
+// cycles.
+func (p *Parser) discover(
+	ctx context.Context,
+	source string,
+	including []string,
+	seen map[string]bool,
+	discovered *[]discoveredSource,
+) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("ordering sources: %w", err)
+	}
+
+	if slices.Contains(including, source) {
+		return fmt.Errorf(
+			"%w: %s -> %s",
+			ErrIncludeCycle,
+			strings.Join(including, " -> "),
+			source,
+		)
+	}
+
+	if seen[source] {
+		return nil
+	}
+
+	seen[source] = true
+
+	// Sources are parsed before they're discovered, see discoverSources.
+	parsed, _ := p.cache.get(source)
+	frontMatter := parsed.frontMatter
+
+	reason, err := p.skipReason(ctx, source, frontMatter)
+	if err != nil {
+		return err
+	}
+
+	if reason != "" {
+		if p.Verbose {
+			p.logger().Info("Skipping "+source, "reason", reason)
+		}
+
+		return nil
+	}
+
+	if p.Verbose && frontMatter.When != (SourceConditions{}) {
+		p.logger().Info("Conditions met for " + source)
+	}
+
+	bodyIncludes, err := getIncludes(parsed.config)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, source)
+	}
+
+	var included []string
+
+	for _, pattern := range slices.Concat(frontMatter.Include, bodyIncludes) {
+		matches, err := p.expandInclude(ctx, source, pattern)
+		if err != nil {
+			return err
+		}
+
+		included = append(included, matches...)
+	}
+
+	// Parse everything this source includes at once, before following them.
+	err = p.parseSources(ctx, included)
+	if err != nil {
+		return err
+	}
+
+	for _, includedSource := range included {
+		p.debugf("Including %s from %s\n", includedSource, source)
+
+		err = p.discover(
+			ctx,
+			includedSource,
+			append(slices.Clip(including), source),
+			seen,
+			discovered,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	*discovered = append(*discovered, discoveredSource{name: source, frontMatter: frontMatter})
+
+	return nil
+}
+
+// expandInclude resolves an include relative to the directory of the source
+// that included it, expanding it if it's a glob. A glob that matches nothing
+// is fine, but a plain path must exist.
+func (p *Parser) expandInclude(
+	ctx context.Context,
+	source string,
+	pattern string,
+) ([]string, error) {
+	pattern, err := relativeToSource(source, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, name, err := p.sourceFS(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.ContainsAny(name, `*?[\`) {
+		_, err := fs.Stat(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s from %s: %w", ErrIncludeNotFound, pattern, source, err)
+		}
+
+		return []string{pattern}, nil
+	}
+
+	// Matches in a git repository are sources in it too.
+	if prefix, _ := SplitSource(pattern); prefix == GitSourcePrefix {
+		return ExpandGitSource(ctx, pattern)
+	}
+
+	matches, err := fs.Glob(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("expanding include %s from %s: %w", pattern, source, err)
+	}
+
+	return matches, nil
+}
+
+// getIncludes returns the includes listed in a source's top level include
+// block, if it has one. A mapping there is a group named include, which
+// would otherwise be lost, so it's an error.
+func getIncludes(config *orderedmap.OrderedMap[string, any]) ([]string, error) {
+	value, ok := config.Get(includeBlock)
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	if _, isMap := value.(map[string]any); isMap {
+		return nil, ErrIncludeIsGroup
+	}
+
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrIncludeNotListOfStrings, value)
+	}
+
+	includes := make([]string, 0, len(list))
+
+	for _, item := range list {
+		include, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", ErrIncludeNotListOfStrings, value)
+		}
+
+		includes = append(includes, include)
+	}
+
+	return includes, nil
+}
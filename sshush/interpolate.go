@@ -0,0 +1,128 @@
+package sshush
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+var (
+	ErrUndefinedVariable    = errors.New("undefined variable")
+	ErrUnterminatedVariable = errors.New("unterminated variable")
+)
+
+// lookupFunc returns the value of a variable and whether it was defined.
+type lookupFunc func(name string) (string, bool)
+
+// interpolateConfig replaces variables in every string value of the config,
+// in place. Keys are left alone.
+func interpolateConfig(configMap *orderedmap.OrderedMap[string, any], lookup lookupFunc) error {
+	for pair := configMap.Oldest(); pair != nil; pair = pair.Next() {
+		value, err := interpolateValue(pair.Value, lookup)
+		if err != nil {
+			return fmt.Errorf("%s: %w", pair.Key, err)
+		}
+
+		pair.Value = value
+	}
+
+	return nil
+}
+
+// interpolateValue replaces variables in a value, recursing into maps and
+// lists. Anything other than a string, such as a Port number, is returned
+// unchanged.
+func interpolateValue(value any, lookup lookupFunc) (any, error) {
+	switch typedValue := value.(type) {
+	case string:
+		return interpolate(typedValue, lookup)
+	case map[string]any:
+		for key, nestedValue := range typedValue {
+			interpolated, err := interpolateValue(nestedValue, lookup)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+
+			typedValue[key] = interpolated
+		}
+	case []any:
+		for i, nestedValue := range typedValue {
+			interpolated, err := interpolateValue(nestedValue, lookup)
+			if err != nil {
+				return nil, err
+			}
+
+			typedValue[i] = interpolated
+		}
+	}
+
+	return value, nil
+}
+
+// interpolate replaces ${NAME} with the value of NAME, and ${NAME:-default}
+// with the value of NAME or default if it isn't defined. $${ is a literal ${.
+// A $ that isn't followed by { is left alone, so ProxyCommand and the like
+// don't need escaping.
+func interpolate(s string, lookup lookupFunc) (string, error) {
+	var builder strings.Builder
+
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			builder.WriteString(s)
+
+			return builder.String(), nil
+		}
+
+		// An escaped $${ is written as ${ without being interpolated.
+		if start > 0 && s[start-1] == '$' {
+			builder.WriteString(s[:start-1] + "${")
+			s = s[start+2:]
+
+			continue
+		}
+
+		end := strings.IndexByte(s[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("%w: %s", ErrUnterminatedVariable, s[start:])
+		}
+
+		name, fallback, hasFallback := strings.Cut(s[start+2:start+end], ":-")
+
+		value, ok := lookup(name)
+		if !ok {
+			if !hasFallback {
+				return "", fmt.Errorf("%w: %s", ErrUndefinedVariable, name)
+			}
+
+			value = fallback
+		}
+
+		builder.WriteString(s[:start] + value)
+		s = s[start+end+1:]
+	}
+}
+
+// chainLookups returns a lookup that tries each lookup in turn.
+func chainLookups(lookups ...lookupFunc) lookupFunc {
+	return func(name string) (string, bool) {
+		for _, lookup := range lookups {
+			if value, ok := lookup(name); ok {
+				return value, true
+			}
+		}
+
+		return "", false
+	}
+}
+
+// mapLookup returns a lookup for the variables in the map.
+func mapLookup(vars map[string]string) lookupFunc {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+
+		return value, ok
+	}
+}
@@ -0,0 +1,367 @@
+package sshush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// jsonBlock is the key of a group's generic JSON provider block.
+	jsonBlock = "JSON"
+	// ec2Block is the key of a group's EC2 provider block.
+	ec2Block = "EC2"
+
+	// ec2Items, ec2Alias, ec2HostName and ec2State are the queries for
+	// describe-instances output.
+	ec2Items    = "Reservations[].Instances[]"
+	ec2Alias    = "tags.Name"
+	ec2HostName = "PublicIpAddress"
+	ec2State    = "State.Name"
+)
+
+type (
+	// jsonMapping is a group's JSON block: which items in a JSON file are
+	// hosts, and which of their attributes to use. Each is a JMESPath query,
+	// see https://jmespath.org.
+	jsonMapping struct {
+		// File is the path of the JSON file, relative to the source.
+		File string `yaml:"File"`
+		// Items is the query for the list of hosts within the file, e.g.
+		// servers or Reservations[].Instances[]. Defaults to the whole file.
+		Items string `yaml:"Items"`
+		// Alias is the query, on each item, to name the host by.
+		Alias string `yaml:"Alias"`
+		// HostName is the query, on each item, for the HostName.
+		HostName string `yaml:"HostName"`
+		// Filter limits the hosts to those where each query has one of the
+		// values.
+		Filter map[string]stringList `yaml:"Filter"`
+		// GroupBy splits the hosts into a group for each value of the query.
+		// Each is named after the group and the value, and extends the
+		// group.
+		GroupBy string `yaml:"GroupBy"`
+	}
+
+	// jsonQueries is a jsonMapping with its queries compiled.
+	jsonQueries struct {
+		items    *jmespath.JMESPath
+		alias    *jmespath.JMESPath
+		hostName *jmespath.JMESPath
+		groupBy  *jmespath.JMESPath
+		filters  []jsonFilter
+	}
+
+	// jsonFilter is a compiled Filter query and the values it must have.
+	jsonFilter struct {
+		query  *jmespath.JMESPath
+		values stringList
+	}
+
+	// ec2Mapping is a group's EC2 block, for the saved output of
+	// aws ec2 describe-instances. Instance tags can be used as tags.Name.
+	ec2Mapping struct {
+		File string `yaml:"File"`
+		// Alias defaults to tags.Name.
+		Alias string `yaml:"Alias"`
+		// HostName defaults to PublicIpAddress.
+		HostName string `yaml:"HostName"`
+		// States defaults to running.
+		States  stringList `yaml:"States"`
+		GroupBy string     `yaml:"GroupBy"`
+	}
+
+	// stringList is a list of strings that may be written as a single
+	// string.
+	stringList []string
+)
+
+var (
+	ErrJSONItems = errors.New("invalid json items")
+	ErrJSONQuery = errors.New("invalid JMESPath query")
+)
+
+// UnmarshalYAML reads a single string or a list of strings.
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+
+		return nil
+	}
+
+	var list []string
+
+	err := value.Decode(&list)
+	if err != nil {
+		return fmt.Errorf("decoding list: %w", err)
+	}
+
+	*l = list
+
+	return nil
+}
+
+// jsonGroups returns the hosts from a group's JSON block.
+func (p *Parser) jsonGroups(ctx context.Context, source string, block any) (providedGroups, error) {
+	var mapping jsonMapping
+
+	err := decodeBlock(block, &mapping)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", jsonBlock, err)
+	}
+
+	return p.mappedGroups(ctx, source, mapping, nil)
+}
+
+// ec2Groups returns the hosts from a group's EC2 block, which is a JSON
+// mapping with defaults for describe-instances output.
+func (p *Parser) ec2Groups(ctx context.Context, source string, block any) (providedGroups, error) {
+	var ec2 ec2Mapping
+
+	err := decodeBlock(block, &ec2)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ec2Block, err)
+	}
+
+	mapping := jsonMapping{
+		File:     ec2.File,
+		Items:    ec2Items,
+		Alias:    orDefault(ec2.Alias, ec2Alias),
+		HostName: orDefault(ec2.HostName, ec2HostName),
+		Filter:   map[string]stringList{ec2State: ec2.States},
+		GroupBy:  ec2.GroupBy,
+	}
+
+	if len(ec2.States) == 0 {
+		mapping.Filter[ec2State] = stringList{"running"}
+	}
+
+	return p.mappedGroups(ctx, source, mapping, ec2Tags)
+}
+
+// mappedGroups reads the JSON file and maps its items to hosts. prepare, if
+// given, is applied to each item first. An item with the same alias as an
+// earlier one is skipped with a warning.
+func (p *Parser) mappedGroups(
+	ctx context.Context,
+	source string,
+	mapping jsonMapping,
+	prepare func(item any) any,
+) (providedGroups, error) {
+	if mapping.File == "" || mapping.Alias == "" || mapping.HostName == "" {
+		return nil, fmt.Errorf("%w: needs File, Alias and HostName", ErrProviderMapping)
+	}
+
+	queries, err := mapping.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	contents, filePath, err := p.readProviderFile(ctx, source, mapping.File)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := readJSONItems(filePath, contents, queries.items)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(providedGroups)
+	hostNames := make(map[string]string)
+
+	for _, item := range items {
+		if prepare != nil {
+			item = prepare(item)
+		}
+
+		if !queries.included(item) {
+			continue
+		}
+
+		alias, aliasOK := queryValue(queries.alias, item)
+		hostName, hostNameOK := queryValue(queries.hostName, item)
+
+		if !aliasOK || !hostNameOK {
+			p.logger().Warn(
+				"skipping item without an alias or HostName",
+				"file", filePath,
+				"alias", mapping.Alias,
+				"host_name", mapping.HostName,
+			)
+
+			continue
+		}
+
+		alias = hostsName(alias)
+
+		if first, ok := hostNames[alias]; ok {
+			p.logger().Warn(
+				"skipping item with the same alias as another",
+				"file", filePath, "host", alias, "first", first, "second", hostName,
+			)
+
+			continue
+		}
+
+		hostNames[alias] = hostName
+
+		group, _ := queryValue(queries.groupBy, item)
+
+		if groups[hostsName(group)] == nil {
+			groups[hostsName(group)] = make(map[string]any)
+		}
+
+		groups[hostsName(group)][alias] = hostName
+	}
+
+	return groups, nil
+}
+
+// compile compiles the mapping's queries.
+func (m jsonMapping) compile() (*jsonQueries, error) {
+	var (
+		queries jsonQueries
+		err     error
+	)
+
+	for _, query := range []struct {
+		compiled   **jmespath.JMESPath
+		expression string
+	}{
+		{&queries.items, m.Items},
+		{&queries.alias, m.Alias},
+		{&queries.hostName, m.HostName},
+		{&queries.groupBy, m.GroupBy},
+	} {
+		*query.compiled, err = compileQuery(query.expression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for expression, values := range m.Filter {
+		query, err := compileQuery(expression)
+		if err != nil {
+			return nil, err
+		}
+
+		queries.filters = append(queries.filters, jsonFilter{query: query, values: values})
+	}
+
+	return &queries, nil
+}
+
+// compileQuery compiles a JMESPath query, or returns nil if it's empty.
+func compileQuery(expression string) (*jmespath.JMESPath, error) {
+	if expression == "" {
+		return nil, nil
+	}
+
+	query, err := jmespath.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrJSONQuery, expression, err)
+	}
+
+	return query, nil
+}
+
+// readJSONItems parses the JSON file and returns the items the query
+// selects, or the whole file if there isn't one.
+func readJSONItems(filePath string, contents []byte, query *jmespath.JMESPath) ([]any, error) {
+	var root any
+
+	err := json.Unmarshal(contents, &root)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrParsingSourceFile, filePath, err)
+	}
+
+	selected := root
+
+	if query != nil {
+		selected, err = query.Search(root)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrJSONItems, filePath, err)
+		}
+	}
+
+	switch items := selected.(type) {
+	case nil:
+		return nil, nil
+	case []any:
+		return items, nil
+	default:
+		return []any{items}, nil
+	}
+}
+
+// included reports whether the item passes the mapping's filters.
+func (q *jsonQueries) included(item any) bool {
+	for _, filter := range q.filters {
+		value, _ := queryValue(filter.query, item)
+		if !slices.Contains(filter.values, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// queryValue returns the result of the query on the item as a string, if
+// it's a single value.
+func queryValue(query *jmespath.JMESPath, item any) (string, bool) {
+	if query == nil {
+		return "", false
+	}
+
+	value, err := query.Search(item)
+	if err != nil {
+		return "", false
+	}
+
+	return scalarString(value)
+}
+
+// ec2Tags adds the instance's tags as a map, so that they can be used as
+// tags.Name rather than needing Tags[?Key=='Name'].Value | [0].
+func ec2Tags(item any) any {
+	instance, ok := item.(map[string]any)
+	if !ok {
+		return item
+	}
+
+	tags := make(map[string]any)
+
+	list, _ := instance["Tags"].([]any)
+	for _, tag := range list {
+		tagMap, _ := tag.(map[string]any)
+		if key, ok := tagMap["Key"].(string); ok {
+			tags[key] = tagMap["Value"]
+		}
+	}
+
+	instance["tags"] = tags
+
+	return instance
+}
+
+// hostsName makes a name usable as a Host alias or a group name, replacing
+// whitespace with hyphens.
+func hostsName(name string) string {
+	return strings.Join(strings.Fields(name), "-")
+}
+
+// orDefault returns value, or fallback if it's empty.
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
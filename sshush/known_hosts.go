@@ -0,0 +1,279 @@
+package sshush
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // known_hosts hashing is defined as HMAC-SHA1.
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// hostKeysBlock is the key a host's public keys are declared under, on
+	// a group or a host.
+	hostKeysBlock = "HostKeys"
+	// certAuthorityBlock is the key a group's host certificate authorities
+	// are declared under.
+	certAuthorityBlock = "CertAuthority"
+
+	// knownHostsSuffix is appended to the destination to name the known_hosts
+	// file written alongside it, unless KnownHostsFile is set.
+	knownHostsSuffix = ".known_hosts"
+	// certAuthorityMarker marks a known_hosts line as a certificate authority.
+	certAuthorityMarker = "@cert-authority"
+	// hashedHostPrefix starts a hashed known_hosts host name.
+	hashedHostPrefix = "|1|"
+	// hashSaltSize is the size of a hashed name's salt, as ssh-keygen uses.
+	hashSaltSize = sha1.Size
+	// defaultSSHPort is left out of known_hosts names.
+	defaultSSHPort = "22"
+)
+
+// hashedNames is the hashed names in an existing known_hosts file, by the
+// key they're for, so that a name's hash can be reused rather than salted
+// afresh each time the file is written.
+type hashedNames map[string][]string
+
+var (
+	ErrHostKeysNotListOfStrings = errors.New("host keys is not a list of strings")
+	ErrInvalidHostKey           = errors.New("invalid host key")
+)
+
+// getHostKeys returns the public keys declared under key in a group or
+// host's config, as they'd be written in known_hosts. A single key may be
+// given as a string rather than a list.
+func getHostKeys(config any, key string) ([]string, error) {
+	configMap, ok := config.(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+
+	var values []any
+
+	switch typedKeys := configMap[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		values = []any{typedKeys}
+	case []any:
+		values = typedKeys
+	default:
+		return nil, fmt.Errorf("%w: %s: %v", ErrHostKeysNotListOfStrings, key, typedKeys)
+	}
+
+	keys := make([]string, 0, len(values))
+
+	for _, value := range values {
+		keyString, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s: %v", ErrHostKeysNotListOfStrings, key, values)
+		}
+
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyString))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidHostKey, keyString, err)
+		}
+
+		// Written without any comment, so the same key is always the same.
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))))
+	}
+
+	return keys, nil
+}
+
+// KnownHosts returns the known_hosts lines for the host keys and
+// certificate authorities declared in the sources. Each host is known by
+// its alias and its HostName, with the port if it isn't 22. If hash is set,
+// names are hashed as ssh-keygen -H would, with one line per name and a
+// random salt. A hashed name from the existing lines is reused if it's for
+// the same name and key, so that the file only changes when the hosts do.
+// Wildcard patterns can't be hashed, so are always written as they are.
+// Hosts that set their own UserKnownHostsFile are left out.
+func (c *Config) KnownHosts(hash bool, existing []string) ([]string, error) {
+	var lines []string
+
+	hashed := readHashedNames(existing)
+
+	for _, group := range c.Groups {
+		var groupNames []string
+
+		for _, host := range group.Hosts {
+			// A host with its own UserKnownHostsFile looks after its keys.
+			if host.Value("UserKnownHostsFile") != "" {
+				continue
+			}
+
+			names := host.knownHostsNames()
+			groupNames = append(groupNames, names...)
+
+			for _, key := range host.HostKeys {
+				hostLines, err := hashed.lines("", names, key, hash)
+				if err != nil {
+					return nil, err
+				}
+
+				lines = append(lines, hostLines...)
+			}
+		}
+
+		if len(groupNames) == 0 {
+			continue
+		}
+
+		for _, key := range group.CertAuthorities {
+			caLines, err := hashed.lines(certAuthorityMarker, groupNames, key, hash)
+			if err != nil {
+				return nil, err
+			}
+
+			lines = append(lines, caLines...)
+		}
+	}
+
+	return lines, nil
+}
+
+// UseKnownHostsFile sets UserKnownHostsFile to the file on each host with
+// host keys or a certificate authority, unless it sets its own.
+func (c *Config) UseKnownHostsFile(file string) {
+	for i, group := range c.Groups {
+		for j, host := range group.Hosts {
+			if len(host.HostKeys) == 0 && len(group.CertAuthorities) == 0 {
+				continue
+			}
+
+			if host.Value("UserKnownHostsFile") != "" {
+				continue
+			}
+
+			directive := Directive{
+				Key:    "UserKnownHostsFile",
+				Values: []string{file},
+				Origin: OriginKnownHosts,
+			}
+
+			// Keep the directives sorted, after HostName.
+			index, _ := slices.BinarySearchFunc(
+				host.Directives,
+				directive,
+				func(a, b Directive) int {
+					if a.Key == "HostName" {
+						return -1
+					}
+
+					return strings.Compare(a.Key, b.Key)
+				},
+			)
+
+			c.Groups[i].Hosts[j].Directives = slices.Insert(host.Directives, index, directive)
+		}
+	}
+}
+
+// knownHostsNames returns the names the host is known by in known_hosts.
+func (h Host) knownHostsNames() []string {
+	names := []string{h.Alias}
+
+	if hostName := h.Value("HostName"); hostName != "" && hostName != h.Alias {
+		names = append(names, hostName)
+	}
+
+	port := h.Value("Port")
+	if port == "" || port == defaultSSHPort {
+		return names
+	}
+
+	for i, name := range names {
+		names[i] = knownhosts.Normalize(net.JoinHostPort(name, port))
+	}
+
+	return names
+}
+
+// readHashedNames returns the hashed names in the known_hosts lines.
+func readHashedNames(lines []string) hashedNames {
+	hashed := make(hashedNames)
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			fields = fields[1:]
+		}
+
+		//nolint:mnd // The name, the key type and the key.
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], hashedHostPrefix) {
+			continue
+		}
+
+		key := fields[1] + " " + fields[2]
+		hashed[key] = append(hashed[key], fields[0])
+	}
+
+	return hashed
+}
+
+// lines returns the lines for the key, with the marker if there is one.
+// Hashed names get a line each.
+func (h hashedNames) lines(marker string, names []string, key string, hash bool) ([]string, error) {
+	prefix := ""
+	if marker != "" {
+		prefix = marker + " "
+	}
+
+	if !hash {
+		return []string{prefix + strings.Join(names, ",") + " " + key}, nil
+	}
+
+	lines := make([]string, 0, len(names))
+
+	for _, name := range names {
+		hashedName, err := h.hash(name, key)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, prefix+hashedName+" "+key)
+	}
+
+	return lines, nil
+}
+
+// hash hashes a known_hosts name for the key, unless it's a wildcard
+// pattern, reusing the existing hash if there is one.
+func (h hashedNames) hash(name, key string) (string, error) {
+	if strings.ContainsAny(name, "*?!") {
+		return name, nil
+	}
+
+	for _, hashed := range h[key] {
+		if hashMatches(hashed, name) {
+			return hashed, nil
+		}
+	}
+
+	salt := make([]byte, hashSaltSize)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("salting host name: %w", err)
+	}
+
+	return hashedHostPrefix +
+		base64.StdEncoding.EncodeToString(salt) + "|" +
+		base64.StdEncoding.EncodeToString(hostNameHash(salt, name)), nil
+}
+
+// hostNameHash is the hash of a known_hosts name with the salt.
+func hostNameHash(salt []byte, name string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+
+	return mac.Sum(nil)
+}
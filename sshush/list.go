@@ -0,0 +1,152 @@
+package sshush
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// FormatTable is a human readable table, for listing hosts.
+const FormatTable = "table"
+
+// HostSummary is a host as listed by ListHosts: just enough to find the host
+// you're after.
+type HostSummary struct {
+	Alias    string   `json:"alias"     yaml:"alias"`
+	HostName string   `json:"host_name" yaml:"host_name"`
+	User     string   `json:"user"      yaml:"user"`
+	Group    string   `json:"group"     yaml:"group"`
+	Tags     []string `json:"tags"      yaml:"tags"`
+}
+
+// Hosts returns every host in every group, in the order they're rendered.
+func (c *Config) Hosts() []Host {
+	var hosts []Host
+
+	for _, group := range c.Groups {
+		hosts = append(hosts, group.Hosts...)
+	}
+
+	return hosts
+}
+
+// Tags returns every tag used by a host, sorted.
+func (c *Config) Tags() []string {
+	var tags []string
+
+	for _, host := range c.Hosts() {
+		tags = append(tags, host.Tags...)
+	}
+
+	return mergeTags(tags)
+}
+
+// Value returns the first value of the host's directive with the given key,
+// or an empty string if it has none.
+func (h Host) Value(key string) string {
+	for _, directive := range h.Directives {
+		if directive.Key == key && len(directive.Values) > 0 {
+			return directive.Values[0]
+		}
+	}
+
+	return ""
+}
+
+// Summary returns the host's summary for listing.
+func (h Host) Summary() HostSummary {
+	return HostSummary{
+		Alias:    h.Alias,
+		HostName: h.Value("HostName"),
+		User:     h.Value("User"),
+		Group:    h.Group,
+		Tags:     h.Tags,
+	}
+}
+
+// SearchHosts returns the hosts matching the query. Hosts whose alias,
+// HostName or group contain the query come first, followed by those whose
+// alias fuzzily matches it, i.e. contains its characters in order, so "pdb"
+// finds "prod-db1". Matching is case insensitive and an empty query matches
+// every host.
+func SearchHosts(hosts []Host, query string) []Host {
+	query = strings.ToLower(query)
+
+	var substringMatches, fuzzyMatches []Host
+
+	for _, host := range hosts {
+		summary := host.Summary()
+
+		switch {
+		case containsFold(summary.Alias, query),
+			containsFold(summary.HostName, query),
+			containsFold(summary.Group, query):
+			substringMatches = append(substringMatches, host)
+		case fuzzyMatch(strings.ToLower(summary.Alias), query):
+			fuzzyMatches = append(fuzzyMatches, host)
+		}
+	}
+
+	return append(substringMatches, fuzzyMatches...)
+}
+
+// containsFold reports whether s contains the lower case substr, ignoring
+// case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), substr)
+}
+
+// fuzzyMatch reports whether s contains every character of pattern, in
+// order, though not necessarily next to each other.
+func fuzzyMatch(s, pattern string) bool {
+	for _, r := range pattern {
+		i := strings.IndexRune(s, r)
+		if i == -1 {
+			return false
+		}
+
+		s = s[i+utf8.RuneLen(r):]
+	}
+
+	return true
+}
+
+// ListHosts writes a summary of each host to w, as a table or encoded as JSON
+// or YAML.
+func ListHosts(w io.Writer, hosts []Host, format string) error {
+	summaries := make([]HostSummary, 0, len(hosts))
+
+	for _, host := range hosts {
+		summaries = append(summaries, host.Summary())
+	}
+
+	if format != FormatTable {
+		return encode(w, summaries, format)
+	}
+
+	//nolint:mnd // Two spaces between columns.
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(table, "ALIAS\tHOSTNAME\tUSER\tGROUP\tTAGS")
+
+	for _, summary := range summaries {
+		_, _ = fmt.Fprintf(
+			table,
+			"%s\t%s\t%s\t%s\t%s\n",
+			summary.Alias,
+			summary.HostName,
+			summary.User,
+			summary.Group,
+			strings.Join(summary.Tags, ","),
+		)
+	}
+
+	err := table.Flush()
+	if err != nil {
+		return fmt.Errorf("writing table: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package sshush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ModelSchemaVersion is the version of the resolved model's schema, as
+// emitted by EncodeConfig. Fields may be added without changing it, but it is
+// incremented whenever a field is removed or changes meaning.
+const ModelSchemaVersion = 1
+
+// Origins of a directive's values. A directive inherited through Extends has
+// the origin OriginExtendsPrefix followed by the name of the group it came
+// from, e.g. "extends:ciscos". OriginKnownHosts is the UserKnownHostsFile
+// set for hosts with host keys.
+const (
+	OriginGlobal        = "global"
+	OriginDefault       = "default"
+	OriginExtendsPrefix = "extends:"
+	OriginGroup         = "group"
+	OriginHost          = "host"
+	OriginKnownHosts    = "known_hosts"
+)
+
+// Formats the resolved model can be encoded in.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+type (
+	// Config is the fully resolved configuration: every group and host with
+	// the global, default, Extends, group and host level config merged.
+	Config struct {
+		SchemaVersion int         `json:"schema_version" yaml:"schema_version"`
+		Sources       []string    `json:"sources"        yaml:"sources"`
+		Groups        []Group     `json:"groups"         yaml:"groups"`
+		Global        []Directive `json:"global"         yaml:"global"`
+	}
+
+	// Group is a resolved group of hosts. Tags and CertAuthorities include
+	// those inherited through Extends.
+	Group struct {
+		Name            string   `json:"name"             yaml:"name"`
+		Prefix          string   `json:"prefix"           yaml:"prefix"`
+		Extends         string   `json:"extends"          yaml:"extends"`
+		Source          string   `json:"source"           yaml:"source"`
+		Tags            []string `json:"tags"             yaml:"tags"`
+		CertAuthorities []string `json:"cert_authorities" yaml:"cert_authorities"`
+		Hosts           []Host   `json:"hosts"            yaml:"hosts"`
+	}
+
+	// Host is a resolved host. Name is as declared in the source, Alias is
+	// the name used in the generated Host line, including any group prefix.
+	// Pattern is true for wildcard hosts, which have no HostName of their own.
+	// Tags and HostKeys are the host's own along with its group's.
+	Host struct {
+		Name       string      `json:"name"       yaml:"name"`
+		Alias      string      `json:"alias"      yaml:"alias"`
+		Group      string      `json:"group"      yaml:"group"`
+		Source     string      `json:"source"     yaml:"source"`
+		Pattern    bool        `json:"pattern"    yaml:"pattern"`
+		Tags       []string    `json:"tags"       yaml:"tags"`
+		HostKeys   []string    `json:"host_keys"  yaml:"host_keys"`
+		Directives []Directive `json:"directives" yaml:"directives"`
+	}
+
+	// Directive is a single SSH config keyword with its effective values, in
+	// order. Keywords such as LocalForward may have several values, each of
+	// which is written as its own line. Origin is the level of config the
+	// values came from, see the Origin constants.
+	Directive struct {
+		Key    string   `json:"key"    yaml:"key"`
+		Values []string `json:"values" yaml:"values"`
+		Origin string   `json:"origin" yaml:"origin"`
+	}
+)
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+// EncodeConfig writes the resolved model to w in the given format.
+func EncodeConfig(w io.Writer, config *Config, format string) error {
+	return encode(w, config, format)
+}
+
+// encode writes v to w as JSON or YAML.
+func encode(w io.Writer, v any, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		err := encoder.Encode(v)
+		if err != nil {
+			return fmt.Errorf("encoding json: %w", err)
+		}
+	case FormatYAML:
+		encoder := yaml.NewEncoder(w)
+		//nolint:mnd // Indent by two spaces, as our sources are.
+		encoder.SetIndent(2)
+
+		err := encoder.Encode(v)
+		if err != nil {
+			return fmt.Errorf("encoding yaml: %w", err)
+		}
+
+		err = encoder.Close()
+		if err != nil {
+			return fmt.Errorf("encoding yaml: %w", err)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+
+	return nil
+}
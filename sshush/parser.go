@@ -1,101 +1,181 @@
 package sshush
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
+	"net/http"
 	"os"
 	"sort"
-	"strings"
+	"time"
 
-	"github.com/adrg/frontmatter"
 	"github.com/k0kubun/pp/v3"
 	orderedmap "github.com/wk8/go-ordered-map/v2"
-	"gopkg.in/yaml.v3"
 )
 
 type (
 	Parser struct {
 		GlobalConfig      map[string]any
 		DefaultConfig     map[string]any
-		Extensions        map[string]ExtendsConfig
 		UnprocessedConfig *orderedmap.OrderedMap[string, any]
+		Sources           *SSHConfigSources
+		GroupSources      map[string]string
 		Verbose           bool
 		Debug             bool
 		DryRun            bool
-	}
-
+		// Extensions is each group's Config merged with that of the groups
+		// it extends, set by Load.
+		//
+		// Deprecated: Use Resolve, whose groups and hosts have their
+		// inherited config resolved.
+		Extensions map[string]ExtendsConfig
+		// Logger receives warnings. Defaults to slog.Default().
+		Logger *slog.Logger
+		// Out receives debug output. Defaults to os.Stdout.
+		Out io.Writer
+		// FS is where sources are read from. Defaults to the OS filesystem.
+		FS fs.FS
+		// Stdin is read for the source StdinSource. Defaults to os.Stdin.
+		Stdin io.Reader
+		// Vars are interpolated into the sources, taking precedence over
+		// those in a source's front matter and the environment.
+		Vars map[string]string
+		// LookupEnv looks up environment variables for interpolation and env
+		// conditions. Defaults to os.LookupEnv.
+		LookupEnv func(name string) (string, bool)
+		// Hostname returns the local hostname, for sources with a hostname
+		// condition. Defaults to os.Hostname.
+		Hostname func() (string, error)
+		// Concurrency is how many sources may be parsed at once.
+		// Defaults to GOMAXPROCS.
+		Concurrency int
+		// ExecTimeout is how long a command source may run for.
+		// Defaults to DefaultExecTimeout.
+		ExecTimeout time.Duration
+		// ExecCacheTTL is how long a command source's output is reused for,
+		// rather than running it again. Output isn't cached if it's zero.
+		ExecCacheTTL time.Duration
+		// CacheDir is where command output and downloaded sources are
+		// cached. Defaults to sshush in the user's cache directory.
+		CacheDir string
+		// CacheFS is what the cache is read from and written to. Nothing is
+		// written to it if DryRun is set. Defaults to the OS filesystem.
+		CacheFS FileSystem
+		// WorkingDir is the directory command sources are run in, which
+		// their cached output is keyed by. Output isn't cached without it.
+		// Defaults to the current directory.
+		WorkingDir string
+		// HTTPClient downloads URL sources. Defaults to a client with a 30
+		// second timeout.
+		HTTPClient *http.Client
+		// Now returns the current time. Defaults to time.Now.
+		Now func() time.Time
+
+		pretty       *pp.PrettyPrinter
+		stdin        []byte
+		cache        sourceCache
+		certificates map[string]bool
+	}
+
+	// SourceFrontMatter is the optional front matter of a source. A source
+	// that isn't Enabled, or whose When conditions aren't all met, is skipped.
+	// Requires names other sources that must be loaded along with it.
+	SourceFrontMatter struct {
+		Priority Priority          `yaml:"priority,omitempty"`
+		Vars     map[string]string `yaml:"vars,omitempty"`
+		Include  []string          `yaml:"include,omitempty"`
+		Enabled  *bool             `yaml:"enabled,omitempty"`
+		When     SourceConditions  `yaml:"when,omitempty"`
+		Requires []string          `yaml:"requires,omitempty"`
+	}
+
+	// ExtendsConfig is a group's Config merged with that of the groups it
+	// extends.
+	//
+	// Deprecated: Use Resolve, and the Config model it returns.
 	ExtendsConfig struct {
 		Identifier string
 		Config     map[string]any
 		Extends    string
 	}
 
-	SourceFrontMatter struct {
-		Priority int `yaml:"priority,omitempty"`
-	}
-
 	PrioritisedSource struct {
-		Priority int
+		Priority Priority
 		Source   string
 	}
 )
 
+// StdinSource is the source name that means read from stdin.
+const StdinSource = "-"
+
 var (
 	ErrConfigNotMap          = errors.New("config is not a map")
 	ErrHostsNotListOfStrings = errors.New("hosts is not list of strings")
 	ErrPrefixNotAString      = errors.New("prefix is not a string")
 	ErrOpeningSourceFile     = errors.New("failed to open source file")
 	ErrParsingSourceFile     = errors.New("failed to parse source file")
+	ErrLoadingProvider       = errors.New("failed to load hosts from provider")
 )
 
-// OrderSources checks each file for optional yaml frontmatter. If frontmatter
-// contains a priority int value, we use that to sort (ascending) each
-// prioritised source. Files with no frontmatter are considered unprioritised
-// and retain their natural ordering.
-func (p *Parser) OrderSources(sources *SSHConfigSources) (*SSHConfigSources, error) {
-	var prioritised []PrioritisedSource
-	var unPrioritised []string
+// OrderSources checks each file for optional yaml frontmatter, and orders the
+// sources by the priority in it. Later sources take precedence, so:
+//
+//   - Sources with a positive priority come first, in ascending order.
+//   - Then sources without a priority, in the order they were given.
+//   - Then sources with a negative priority, in ascending order, so that -1
+//     is loaded after -2.
+//   - Then sources whose priority is "last".
+//
+// Sources with the same priority are ordered by their file name, then their
+// full path, rather than the order they were given.
+// Files included by a source are ordered the same way, as if they had been
+// given just before the source that included them.
+// The context is checked between sources, so a cancelled run stops early.
+func (p *Parser) OrderSources(
+	ctx context.Context,
+	sources *SSHConfigSources,
+) (*SSHConfigSources, error) {
+	discovered, err := p.discoverSources(ctx, *sources)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, sourceFileName := range *sources {
-		sourceFile, err := os.Open(sourceFileName)
-		if err != nil {
-			return nil, fmt.Errorf("%w: %s: %w", ErrOpeningSourceFile, sourceFileName, err)
-		}
+	prioritised := make([]PrioritisedSource, 0, len(discovered))
 
-		frontMatter := &SourceFrontMatter{}
+	for _, source := range discovered {
+		prioritised = append(prioritised, PrioritisedSource{
+			Priority: source.frontMatter.Priority,
+			Source:   source.name,
+		})
 
-		_, err = frontmatter.Parse(sourceFile, frontMatter)
-		if err != nil {
-			return nil, fmt.Errorf("%w: %s: %w", ErrParsingSourceFile, sourceFileName, err)
-		}
-
-		if frontMatter.Priority == 0 {
-			unPrioritised = append(unPrioritised, sourceFileName)
-		} else {
-			prioritised = append(prioritised, PrioritisedSource{
-				Priority: frontMatter.Priority,
-				Source:   sourceFileName,
-			})
-
-			if p.Debug {
-				_, _ = pp.Printf("Prioritised file: %s Priority: %d\n", sourceFileName, frontMatter.Priority)
-			}
+		if source.frontMatter.Priority != 0 {
+			p.debugf(
+				"Prioritised file: %s Priority: %s\n",
+				source.name,
+				source.frontMatter.Priority,
+			)
 		}
 	}
 
 	sort.SliceStable(prioritised, func(i, j int) bool {
-		return prioritised[i].Priority < prioritised[j].Priority
+		return prioritised[i].loadsBefore(prioritised[j])
 	})
 
 	out := SSHConfigSources{}
 
-	for _, source := range prioritised {
+	for i, source := range prioritised {
 		out = append(out, source.Source)
-	}
 
-	for _, source := range unPrioritised {
-		out = append(out, source)
+		if p.Verbose {
+			p.logger().Info(
+				fmt.Sprintf("Source %d: %s", i+1, source.Source),
+				"priority", source.Priority.String(),
+			)
+		}
 	}
 
 	return &out, nil
@@ -103,331 +183,226 @@ func (p *Parser) OrderSources(sources *SSHConfigSources) (*SSHConfigSources, err
 
 // Load loads the configuration from the sources.
 // It processes the global and default config blocks.
-// It also resolves the Extends declarations.
-// It does not process the config itself.
-func (p *Parser) Load(sources *SSHConfigSources) error {
+// It does not process the config itself, see Resolve.
+// The context is checked between sources, so a cancelled run stops early.
+func (p *Parser) Load(ctx context.Context, sources *SSHConfigSources) error {
 	// the map is initialised outside the source loop such that it's appended to.
 	configMap := orderedmap.New[string, any]()
+	p.GroupSources = make(map[string]string)
+
+	// Sources that were ordered by OrderSources have already been parsed.
+	err := p.parseSources(ctx, *sources)
+	if err != nil {
+		return err
+	}
 
 	for _, source := range *sources {
-		contents, err := os.ReadFile(source)
-		if err != nil {
-			return fmt.Errorf("reading file: %w", err)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("loading sources: %w", err)
 		}
 
-		fm := &SourceFrontMatter{}
+		// Interpolation modifies the config in place, so a source mustn't be
+		// loaded from the cache twice. If it's given twice, it's parsed again.
+		parsed, ok := p.cache.get(source)
+		if !ok {
+			parsed, err = p.parseSource(ctx, source)
+			if err != nil {
+				return err
+			}
+		}
+
+		p.cache.delete(source)
 
-		data, err := frontmatter.Parse(strings.NewReader(string(contents)), fm)
+		sourceMap := parsed.config
+
+		err = interpolateConfig(sourceMap, p.lookup(parsed.frontMatter))
 		if err != nil {
-			return fmt.Errorf("parsing frontmatter: %w", err)
+			return fmt.Errorf("interpolating %s: %w", source, err)
 		}
 
-		err = yaml.Unmarshal(data, &configMap)
+		err = p.expandProviders(ctx, source, sourceMap)
 		if err != nil {
-			return fmt.Errorf("unmarshalling yaml: %w", err)
+			return fmt.Errorf("%w: %s: %w", ErrLoadingProvider, source, err)
 		}
 
 		// if global config exists in this source, set it and remove it.
-		p.extractAndSetConfig(configMap, &p.GlobalConfig, "global")
+		p.extractAndSetConfig(sourceMap, &p.GlobalConfig, "global")
 
 		// if default config exists in this source, set it and remove it.
-		p.extractAndSetConfig(configMap, &p.DefaultConfig, "default")
+		p.extractAndSetConfig(sourceMap, &p.DefaultConfig, "default")
+
+		// includes have already been followed by OrderSources.
+		sourceMap.Delete(includeBlock)
+
+		// A group defined again in a later source replaces the earlier one,
+		// but keeps its original position.
+		for pair := sourceMap.Oldest(); pair != nil; pair = pair.Next() {
+			configMap.Set(pair.Key, pair.Value)
+			p.GroupSources[pair.Key] = source
+		}
 	}
 
 	p.UnprocessedConfig = configMap
-
-	// process Extends declarations.
-	p.extractExtensions()
+	p.Sources = sources
+	p.Extensions = p.extensions()
 
 	return nil
 }
 
-// extractAndSetConfig extracts a block from the config map and sets it to the
-// configProperty. It then removes the block from the config map.
-func (p *Parser) extractAndSetConfig(
-	configMap *orderedmap.OrderedMap[string, any],
-	configProperty *map[string]any,
-	blockName string,
-) {
-	if config := extractBlock(blockName, configMap); config != nil {
-		*configProperty = config
-
-		configMap.Delete(blockName)
-	}
-}
-
-// extractExtensions parses all the config and resolves inherited Extends declarations.
-// @see https://sshush.bencromwell.com/docs/configuration/extends/
-func (p *Parser) extractExtensions() {
+// extensions returns each group's Config merged with that of the groups it
+// extends, for the deprecated Extensions. The group's own Config takes
+// precedence, as it does when resolving.
+func (p *Parser) extensions() map[string]ExtendsConfig {
 	extensions := make(map[string]ExtendsConfig)
+
 	for pair := p.UnprocessedConfig.Oldest(); pair != nil; pair = pair.Next() {
 		configMap, ok := pair.Value.(map[string]any)
 		if !ok {
 			continue
 		}
 
-		config, ok := configMap["Config"].(map[string]any)
-		if !ok {
-			continue
-		}
+		chain, _ := p.followExtends(pair.Key, configMap)
+		chain = append(chain, extendedGroup{name: pair.Key, config: configMap})
 
-		extends, ok := configMap["Extends"].(string)
-		if !ok {
-			extends = ""
-		}
+		var merged map[string]any
 
-		extensions[pair.Key] = ExtendsConfig{
-			Identifier: pair.Key,
-			Config:     config,
-			Extends:    extends,
-		}
-	}
+		for _, extends := range chain {
+			if config, ok := extends.config["Config"].(map[string]any); ok {
+				if merged == nil {
+					merged = make(map[string]any)
+				}
 
-	for _, extension := range extensions {
-		if ext, ok := extensions[extension.Extends]; ok {
-			// Update the config to the merged config.
-			ext.Config = mergeMaps(extension.Config, extensions[extension.Extends].Config)
-			extensions[extension.Identifier] = ext
+				maps.Copy(merged, config)
+			}
 		}
-	}
-
-	p.Extensions = extensions
-}
 
-// ProduceConfig produces the SSH configuration.
-func (p *Parser) ProduceConfig() ([]string, error) {
-	var (
-		output []string
-		err    error
-	)
-
-	for pair := p.UnprocessedConfig.Oldest(); pair != nil; pair = pair.Next() {
-		output, err = p.processConfigGroup(pair, output)
-		if err != nil {
-			return nil, err
+		if merged == nil {
+			continue
 		}
-	}
 
-	// Add the global config.
-	if len(p.GlobalConfig) > 0 {
-		output = append(output, "# Global config", "Host *")
-		globalConfigKeys := sortMapByKeys(p.GlobalConfig)
-		// Process the global config in the sorted order of its keys.
-		for _, k := range globalConfigKeys {
-			v := p.GlobalConfig[k]
-			output = appendConfigToOutput(output, k, v)
+		extensions[pair.Key] = ExtendsConfig{
+			Identifier: pair.Key,
+			Config:     merged,
+			Extends:    p.getExtends(configMap),
 		}
 	}
 
-	return output, err
+	return extensions
 }
 
-// processConfigGroup processes a config group.
-// @see https://sshush.bencromwell.com/docs/configuration/groups/
-func (p *Parser) processConfigGroup(
-	pair *orderedmap.Pair[string, any],
-	output []string,
-) ([]string, error) {
-	identifier := pair.Key
-	config := pair.Value
-
-	if p.Debug {
-		_, _ = pp.Println("Identifier: ", identifier)
-		_, _ = pp.Println("Config: ", config)
-	}
-
-	output = append(output, "# "+identifier)
-
-	if configMap, ok := config.(map[string]any); ok {
-		var err error
-
-		output, err = p.processConfigMap(configMap, output)
+// readSource returns the contents of a source, from FS or from stdin.
+// Stdin can only be read once, so its contents are kept for the next call.
+func (p *Parser) readSource(name string) ([]byte, error) {
+	if name != StdinSource {
+		contents, err := fs.ReadFile(p.fs(), name)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("reading %s: %w", name, err)
 		}
-	} else {
-		return nil, fmt.Errorf("%w: %s", ErrConfigNotMap, identifier)
-	}
 
-	return output, nil
-}
-
-// processConfigMap processes the internal representation of the config structure.
-func (p *Parser) processConfigMap(
-	configMap map[string]any,
-	output []string,
-) ([]string, error) {
-	// This group may have a prefix declared.
-	prefix, err := getPrefixFromConfigMap(configMap)
-	if err != nil {
-		return nil, err
+		return contents, nil
 	}
 
-	groupConfig := p.getGroupConfig(configMap)
-
-	if p.Debug {
-		_, _ = pp.Println("Group config: ", groupConfig)
-	}
-
-	hosts, ok := configMap["Hosts"]
-	if !ok {
-		return output, nil
-	}
-
-	// If it's a direct list of hosts, rearrange things.
-	err = expandListToMapOfHosts(configMap, &hosts)
-	if err != nil {
-		return nil, err
-	}
-
-	hostsMap, hostsOk := hosts.(map[string]any)
-	if !hostsOk {
-		return nil, fmt.Errorf("%w: %s", ErrHostsNotListOfStrings, hosts)
-	}
-
-	keys := sortMapByKeys(hostsMap)
-
-	// Process hosts in the sorted order of their keys.
-	for _, host := range keys {
-		hostConfig := getHostConfig(hostsMap[host], groupConfig)
+	if p.stdin == nil {
+		stdin := p.Stdin
+		if stdin == nil {
+			stdin = os.Stdin
+		}
 
-		if p.Debug {
-			_, _ = pp.Println("Host config: ", hostConfig)
+		contents, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading stdin: %w", err)
 		}
 
-		output = append(output, fmt.Sprintf("Host %s%s", prefix, host))
-		output = append(output, p.makeHostConfig(hostConfig)...)
-		output = append(output, "")
+		p.stdin = contents
 	}
 
-	return output, nil
+	return p.stdin, nil
 }
 
-// makeHostConfig produces the config block for the given host configuration.
-func (p *Parser) makeHostConfig(hostConfig map[string]any) []string {
-	var output []string
-
-	// Hoist HostName to the top.
-	hostName := hostConfig["HostName"]
-	delete(hostConfig, "HostName")
-
-	if hostName != nil {
-		output = appendLineToOutput(output, "HostName", hostName)
-	}
-
-	hostConfigKeys := sortMapByKeys(hostConfig)
+// lookup returns the variable lookup for a source: our own Vars, then those
+// in its front matter, then the environment.
+func (p *Parser) lookup(fm *SourceFrontMatter) lookupFunc {
+	return chainLookups(mapLookup(p.Vars), mapLookup(fm.Vars), p.lookupEnv())
+}
 
-	// Process the host config in the sorted order of its keys.
-	for _, k := range hostConfigKeys {
-		output = appendConfigToOutput(output, k, hostConfig[k])
+// lookupEnv returns the lookup for environment variables.
+func (p *Parser) lookupEnv() lookupFunc {
+	if p.LookupEnv == nil {
+		return os.LookupEnv
 	}
 
-	return output
+	return p.LookupEnv
 }
 
-// getGroupConfig returns the config to apply to the entire group.
-func (p *Parser) getGroupConfig(configMap map[string]any) map[string]any {
-	// Start empty.
-	groupConfig := make(map[string]any)
-
-	// Set the defaults.
-	groupConfig = mergeMaps(groupConfig, p.DefaultConfig)
-
-	// If we are extending another config, add that in.
-	groupConfig = mergeMaps(groupConfig, p.getExtendedConfig(configMap))
-
-	// If we have config for this specific group, add that in.
-	if config, ok := configMap["Config"]; ok {
-		//nolint:errcheck,forcetypeassert // We don't return an error from this func, so for the
-		// moment until we can add some test cases around bad config, ignore the
-		// linter's warning.
-		m := config.(map[string]any)
-		groupConfig = mergeMaps(groupConfig, m)
+// fs returns the filesystem to read sources from.
+func (p *Parser) fs() fs.FS {
+	if p.FS == nil {
+		return OSFileSystem{}
 	}
 
-	return groupConfig
+	return p.FS
 }
 
-// getExtendedConfig returns the fully resolved config to extend from.
-// A user can define "Extends" in their config to inherit from another config.
-// @see https://sshush.bencromwell.com/docs/configuration/extends/
-func (p *Parser) getExtendedConfig(configMap map[string]any) map[string]any {
-	extends, extendsExists := configMap["Extends"]
-	if !extendsExists {
-		return make(map[string]any)
+// logger returns the logger to report warnings to.
+func (p *Parser) logger() *slog.Logger {
+	if p.Logger == nil {
+		return slog.Default()
 	}
 
-	extendsStr, extendsExists := extends.(string)
-	if !extendsExists {
-		slog.Warn("extends is not a string")
+	return p.Logger
+}
 
-		return make(map[string]any)
+// debugln pretty prints the values to Out, if debugging is enabled.
+func (p *Parser) debugln(a ...any) {
+	if p.Debug {
+		_, _ = p.printer().Println(a...)
 	}
+}
 
-	extendedConfig, hasTargetConfig := p.Extensions[extendsStr]
-	if hasTargetConfig {
-		if p.Debug {
-			_, _ = pp.Printf("Extended config %s\n", extendsStr)
-			_, _ = pp.Println(extendedConfig)
-		}
-
-		return extendedConfig.Config
+// debugf pretty prints the formatted values to Out, if debugging is enabled.
+func (p *Parser) debugf(format string, a ...any) {
+	if p.Debug {
+		_, _ = p.printer().Printf(format, a...)
 	}
-
-	return make(map[string]any)
 }
 
-// The config to apply to a host consists of any group level config combined
-// with any specific config for this single host. The specific config for this
-// host takes precedence.
-func getHostConfig(hostConfig any, groupConfig map[string]any) map[string]any {
-	var configForThisHost map[string]any
-
-	// If the host config is a string, it's just a HostName.
-	// In which case, the config to apply is that of the group.
-	if hostConfigString, ok := hostConfig.(string); ok {
-		configForThisHost = groupConfig
-		// If the string contains * it's a wildcard so has no specific HostName.
-		if !strings.Contains(hostConfigString, "*") {
-			configForThisHost["HostName"] = hostConfigString
+// printer returns the pretty printer for debug output, creating it on first
+// use. It's our own rather than pp's default, so that we don't change where
+// anyone else's output goes.
+func (p *Parser) printer() *pp.PrettyPrinter {
+	if p.pretty == nil {
+		p.pretty = pp.New()
+
+		if p.Out != nil {
+			p.pretty.SetOutput(p.Out)
 		}
-	} else {
-		// If we had a map, we need to merge the group config with the host config.
-		//nolint:errcheck,forcetypeassert // Pending on adding bad config test cases.
-		configForThisHost = mergeMaps(groupConfig, hostConfig.(map[string]any))
 	}
 
-	return configForThisHost
+	return p.pretty
 }
 
-// MergeMaps merges any number of maps and returns the result.
-// If a key is present, it's overridden by the last map that contains it.
-func mergeMaps(maps ...map[string]any) map[string]any {
-	merged := make(map[string]any)
+// extractAndSetConfig extracts a block from the config map and sets it to the
+// configProperty. It then removes the block from the config map.
+func (p *Parser) extractAndSetConfig(
+	configMap *orderedmap.OrderedMap[string, any],
+	configProperty *map[string]any,
+	blockName string,
+) {
+	if config := extractBlock(blockName, configMap); config != nil {
+		*configProperty = config
 
-	// Iterate over each map.
-	for _, m := range maps {
-		// Copy values from the current map to the merged map.
-		for key, value := range m {
-			merged[key] = value
-		}
+		configMap.Delete(blockName)
 	}
-
-	return merged
 }
 
-// appendLineToOutput appends a key-value pair to the output.
-// It formats the value as a string if it wasn't one.
-// This essentially covers Port numbers, which we get through as ints.
-func appendLineToOutput(output []string, key string, value any) []string {
-	// convert value to string if it's not already.
-	if _, ok := value.(string); !ok {
-		value = fmt.Sprintf("%v", value)
+// ProduceConfig produces the SSH configuration.
+func (p *Parser) ProduceConfig() ([]string, error) {
+	config, err := p.Resolve()
+	if err != nil {
+		return nil, err
 	}
 
-	output = append(output, fmt.Sprintf("    %s %s", key, value))
-
-	return output
+	return Render(config), nil
 }
 
 // extractBlock extracts a block from the config map, if it existed.
@@ -521,22 +496,3 @@ func getPrefixFromConfigMap(configMap map[string]any) (string, error) {
 
 	return prefix, err
 }
-
-// appendConfigToOutput appends a key-value pair to the output.
-// If the value is a map, it will recursively append the key-value pairs.
-func appendConfigToOutput(
-	output []string,
-	key string,
-	value any,
-) []string {
-	switch typedValue := value.(type) {
-	case []any:
-		for _, nestedValue := range typedValue {
-			output = appendConfigToOutput(output, key, nestedValue)
-		}
-	default:
-		output = appendLineToOutput(output, key, typedValue)
-	}
-
-	return output
-}
@@ -0,0 +1,109 @@
+package sshush
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+)
+
+// Priority orders a source relative to the others, see OrderSources. In front
+// matter it's an integer, or "last".
+type Priority int
+
+const (
+	// PriorityLast is the priority of a source that should be loaded after
+	// every other source, written as "last" in front matter.
+	PriorityLast Priority = math.MaxInt
+
+	// priorityLastName is how PriorityLast is written in front matter.
+	priorityLastName = "last"
+)
+
+var ErrInvalidPriority = errors.New(`priority is not an integer or "last"`)
+
+// UnmarshalYAML reads a priority from an integer or "last". It takes an
+// unmarshal function, rather than a yaml.v3 node, as front matter is parsed
+// with yaml.v2.
+func (p *Priority) UnmarshalYAML(unmarshal func(any) error) error {
+	var value string
+
+	err := unmarshal(&value)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPriority, err)
+	}
+
+	if value == priorityLastName {
+		*p = PriorityLast
+
+		return nil
+	}
+
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPriority, value)
+	}
+
+	*p = Priority(priority)
+
+	return nil
+}
+
+// MarshalYAML writes PriorityLast as "last" and anything else as an integer.
+func (p Priority) MarshalYAML() (any, error) {
+	if p == PriorityLast {
+		return priorityLastName, nil
+	}
+
+	return int(p), nil
+}
+
+// String returns the priority as it's written in front matter.
+func (p Priority) String() string {
+	if p == PriorityLast {
+		return priorityLastName
+	}
+
+	return strconv.Itoa(int(p))
+}
+
+// band is which block of sources the priority puts a source in. Positive
+// priorities come first, then unprioritised sources, then negative priorities
+// and finally those that are last.
+func (p Priority) band() int {
+	switch {
+	case p == PriorityLast:
+		return 3 //nolint:mnd // The bands are in order.
+	case p < 0:
+		return 2 //nolint:mnd // The bands are in order.
+	case p == 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// loadsBefore reports whether source a should be loaded before source b. An
+// unprioritised source keeps its position, so two of them are never
+// reordered. Otherwise sources with the same priority are ordered by their
+// file name, then their full path.
+func (a PrioritisedSource) loadsBefore(b PrioritisedSource) bool {
+	if a.Priority.band() != b.Priority.band() {
+		return a.Priority.band() < b.Priority.band()
+	}
+
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+
+	if a.Priority == 0 {
+		return false
+	}
+
+	if filepath.Base(a.Source) != filepath.Base(b.Source) {
+		return filepath.Base(a.Source) < filepath.Base(b.Source)
+	}
+
+	return a.Source < b.Source
+}
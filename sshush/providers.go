@@ -0,0 +1,252 @@
+package sshush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// providedGroups is the hosts from a provider block, keyed by the suffix of
+// the group they belong in. The empty suffix is the group with the block;
+// any other is a group of its own named <group>_<suffix> that extends it.
+type providedGroups map[string]map[string]any
+
+var (
+	ErrProviderNotMap  = errors.New("provider block is not a map")
+	ErrProviderMapping = errors.New("invalid provider mapping")
+)
+
+// expandProviders replaces any provider blocks in the source's groups, such
+// as Terraform, with the hosts they provide. Hosts declared in the group
+// itself take precedence over provided hosts with the same name.
+func (p *Parser) expandProviders(
+	ctx context.Context,
+	source string,
+	sourceMap *orderedmap.OrderedMap[string, any],
+) error {
+	for pair := sourceMap.Oldest(); pair != nil; pair = pair.Next() {
+		group, ok := pair.Value.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		provided, err := p.providedGroups(ctx, source, group)
+		if err != nil {
+			return fmt.Errorf("%s: %w", pair.Key, err)
+		}
+
+		if provided == nil {
+			continue
+		}
+
+		err = mergeProvidedHosts(group, provided[""])
+		if err != nil {
+			return fmt.Errorf("%s: %w", pair.Key, err)
+		}
+
+		addProvidedGroups(sourceMap, pair.Key, group, provided)
+	}
+
+	return nil
+}
+
+// providedGroups returns the hosts from the group's provider block, removing
+// the block, or nil if it doesn't have one.
+func (p *Parser) providedGroups(
+	ctx context.Context,
+	source string,
+	group map[string]any,
+) (providedGroups, error) {
+	if block, ok := group[terraformBlock]; ok {
+		delete(group, terraformBlock)
+
+		hosts, err := p.terraformHosts(ctx, source, block)
+		if err != nil {
+			return nil, err
+		}
+
+		return providedGroups{"": hosts}, nil
+	}
+
+	if block, ok := group[jsonBlock]; ok {
+		delete(group, jsonBlock)
+
+		return p.jsonGroups(ctx, source, block)
+	}
+
+	if block, ok := group[ec2Block]; ok {
+		delete(group, ec2Block)
+
+		return p.ec2Groups(ctx, source, block)
+	}
+
+	return nil, nil //nolint:nilnil // No provider block isn't an error.
+}
+
+// readProviderFile reads a file named in a provider block, relative to the
+// source and from the same place, so that a git source's state file is read
+// from the repository at the same ref. It returns the path it was read from.
+func (p *Parser) readProviderFile(
+	ctx context.Context,
+	source string,
+	name string,
+) ([]byte, string, error) {
+	filePath, err := relativeToSource(source, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fsys, fileName, err := p.sourceFS(ctx, filePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contents, err := fs.ReadFile(fsys, fileName)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s: %w", ErrOpeningSourceFile, filePath, err)
+	}
+
+	return contents, filePath, nil
+}
+
+// addProvidedGroups adds a group for each suffix other than the empty one,
+// straight after the group that provided it and in the sorted order of the
+// suffixes. Each extends the group and shares its Prefix.
+func addProvidedGroups(
+	sourceMap *orderedmap.OrderedMap[string, any],
+	name string,
+	group map[string]any,
+	provided providedGroups,
+) {
+	suffixes := make([]string, 0, len(provided))
+
+	for suffix := range provided {
+		if suffix != "" {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+
+	slices.Sort(suffixes)
+
+	after := name
+
+	for _, suffix := range suffixes {
+		subgroup := map[string]any{
+			"Extends": name,
+			"Hosts":   provided[suffix],
+		}
+
+		if prefix, ok := group["Prefix"]; ok {
+			subgroup["Prefix"] = prefix
+		}
+
+		key := name + "_" + suffix
+
+		sourceMap.Set(key, subgroup)
+		_ = sourceMap.MoveAfter(key, after)
+
+		after = key
+	}
+}
+
+// mergeProvidedHosts adds the provided hosts to the group's Hosts.
+func mergeProvidedHosts(group map[string]any, provided map[string]any) error {
+	if len(provided) == 0 {
+		return nil
+	}
+
+	hosts, ok := group["Hosts"]
+	if !ok {
+		group["Hosts"] = provided
+
+		return nil
+	}
+
+	err := expandListToMapOfHosts(group, &hosts)
+	if err != nil {
+		return err
+	}
+
+	hostsMap, ok := hosts.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrHostsNotListOfStrings, hosts)
+	}
+
+	for name, host := range provided {
+		if _, ok := hostsMap[name]; !ok {
+			hostsMap[name] = host
+		}
+	}
+
+	group["Hosts"] = hostsMap
+
+	return nil
+}
+
+// decodeBlock decodes a provider block into the struct it configures.
+// Unknown keys are an error, to catch typos.
+func decodeBlock(block any, target any) error {
+	if _, ok := block.(map[string]any); !ok {
+		return fmt.Errorf("%w: %v", ErrProviderNotMap, block)
+	}
+
+	encoded, err := yaml.Marshal(block)
+	if err != nil {
+		return fmt.Errorf("encoding provider block: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(encoded))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(target)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProviderMapping, err)
+	}
+
+	return nil
+}
+
+// attributeValue returns the value at a dotted path such as tags.Name or
+// network_interface.0.address, as a string. Lists are indexed by number.
+func attributeValue(attributes any, path string) (string, bool) {
+	value := attributes
+
+	for _, key := range strings.Split(path, ".") {
+		switch typedValue := value.(type) {
+		case map[string]any:
+			value = typedValue[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(typedValue) {
+				return "", false
+			}
+
+			value = typedValue[i]
+		default:
+			return "", false
+		}
+	}
+
+	return scalarString(value)
+}
+
+// scalarString returns a single value, such as a string or a number, as a
+// string. Nothing, maps and lists aren't single values.
+func scalarString(value any) (string, bool) {
+	switch value.(type) {
+	case nil, map[string]any, []any:
+		return "", false
+	default:
+		stringValue := fmt.Sprint(value)
+
+		return stringValue, stringValue != ""
+	}
+}
@@ -0,0 +1,428 @@
+package sshush
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/k0kubun/pp/v3"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// revokedMarker marks a known_hosts line as a revoked key, which is never
+	// pruned.
+	revokedMarker = "@revoked"
+	// managedHostsSuffix is appended to the destination to name the record
+	// of the hosts its config has managed.
+	managedHostsSuffix = ".managed_hosts"
+	// backupTimeFormat names the backups of a known_hosts file after the
+	// first, so that earlier ones aren't overwritten.
+	backupTimeFormat = "20060102150405"
+)
+
+// managedNames is every name the resolved hosts are known by, along with the
+// wildcard patterns of pattern hosts.
+type managedNames struct {
+	names    []string
+	patterns []string
+}
+
+var ErrReadingKnownHosts = errors.New("failed to read known hosts")
+
+// PruneKnownHosts removes the entries from a known_hosts file for hosts that
+// are no longer in the sources, and returns them. An entry is pruned if it's
+// for a host the destination's config has managed, as recorded when it was
+// written, but none of its names is the alias or HostName of a host in the
+// sources now. With all, every entry not in the sources is pruned.
+//
+// Hashed entries are compared by hashing each host's names. Entries for any
+// of the keep patterns, revoked keys and comments are always kept. Tags
+// aren't applied, as every host in the sources is managed.
+// If DryRun is set, a diff is printed rather than the file being written;
+// otherwise the file is backed up first, without replacing earlier backups.
+func (s *Runner) PruneKnownHosts(
+	ctx context.Context,
+	opts Options,
+	file string,
+	keep []string,
+	all bool,
+) ([]string, error) {
+	opts = opts.withDefaults()
+
+	parser, err := s.load(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parser.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProducingConfig, err)
+	}
+
+	contents, err := opts.FS.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrReadingKnownHosts, file, err)
+	}
+
+	previous, err := s.readManagedHosts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if all {
+		previous = nil
+	}
+
+	managed := config.managedNames()
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	kept, pruned := managed.prune(lines, keep, previous)
+
+	if opts.Verbose {
+		for _, line := range pruned {
+			opts.Logger.Info("Pruning " + line)
+		}
+	}
+
+	if opts.DryRun {
+		if len(pruned) == 0 {
+			return nil, nil
+		}
+
+		return pruned, s.printDiff(opts, file, kept)
+	}
+
+	// Record the hosts now, so that they're pruned once they're removed.
+	err = s.recordManagedHosts(opts, managed.list())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+
+	err = s.backupKnownHosts(opts, file, contents)
+	if err != nil {
+		return nil, fmt.Errorf("backup known hosts file: %w", err)
+	}
+
+	err = opts.FS.WriteFile(file, []byte(joinLines(kept)), DestinationConfigFilePermission)
+	if err != nil {
+		return nil, fmt.Errorf("writing known hosts: %w", err)
+	}
+
+	return pruned, nil
+}
+
+// backupKnownHosts backs up a known_hosts file before it's pruned. The first
+// backup is the file with .bak appended; later ones are timestamped, so the
+// original is never overwritten.
+func (s *Runner) backupKnownHosts(opts Options, file string, contents []byte) error {
+	backup := file + ".bak"
+
+	_, err := fs.Stat(opts.FS, backup)
+	if err == nil {
+		backup += "." + opts.Now().Format(backupTimeFormat)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("checking for backup file: %w", err)
+	}
+
+	printer := pp.New()
+	printer.SetOutput(s.Out)
+
+	_, _ = printer.Println("Creating a backup file: " + backup)
+
+	err = opts.FS.WriteFile(backup, contents, DestinationConfigFilePermission)
+	if err != nil {
+		return fmt.Errorf("writing backup file: %w", err)
+	}
+
+	return nil
+}
+
+// managedHostsFile returns where the record of the hosts the destination's
+// config has managed is kept, if anywhere.
+func (s *Runner) managedHostsFile() string {
+	if s.Destination == "" || s.Destination == StdoutDestination {
+		return ""
+	}
+
+	return s.Destination + managedHostsSuffix
+}
+
+// readManagedHosts reads the record of the hosts the destination's config
+// has managed. It's empty if there isn't one.
+func (s *Runner) readManagedHosts(opts Options) (*managedNames, error) {
+	recorded := &managedNames{}
+
+	file := s.managedHostsFile()
+	if file == "" {
+		return recorded, nil
+	}
+
+	contents, err := opts.FS.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return recorded, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrReadingKnownHosts, file, err)
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.ContainsAny(line, "*?"):
+			recorded.patterns = append(recorded.patterns, line)
+		default:
+			recorded.names = append(recorded.names, line)
+		}
+	}
+
+	return recorded, nil
+}
+
+// managesKnownHosts reports whether the destination's hosts are recorded for
+// known-hosts prune: if sshush writes a known_hosts for them, or there's
+// already a record, as there is once known-hosts prune has been run.
+func (s *Runner) managesKnownHosts(opts Options, knownHosts []string) (bool, error) {
+	file := s.managedHostsFile()
+	if file == "" {
+		return false, nil
+	}
+
+	if s.KnownHostsFile != "" || knownHosts != nil {
+		return true, nil
+	}
+
+	_, err := fs.Stat(opts.FS, file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("%w: %s: %w", ErrReadingKnownHosts, file, err)
+	}
+
+	return true, nil
+}
+
+// recordManagedHosts adds the names to the record of the hosts the
+// destination's config has managed. Hosts stay in the record once they've
+// been removed from the sources, which is how prune knows they're stale.
+func (s *Runner) recordManagedHosts(opts Options, names []string) error {
+	file := s.managedHostsFile()
+	if file == "" || names == nil {
+		return nil
+	}
+
+	recorded, err := s.readManagedHosts(opts)
+	if err != nil {
+		return err
+	}
+
+	previous := recorded.list()
+
+	merged := slices.Concat(previous, names)
+	slices.Sort(merged)
+	merged = slices.Compact(merged)
+
+	if slices.Equal(previous, merged) {
+		return nil
+	}
+
+	headers := []string{
+		"# Generated by sshush v" + opts.Version,
+		"# Hosts managed by " + s.Destination + ", for known-hosts prune",
+	}
+
+	err = opts.FS.WriteFile(
+		file,
+		[]byte(joinLines(slices.Concat(headers, merged))),
+		DestinationConfigFilePermission,
+	)
+	if err != nil {
+		return fmt.Errorf("writing managed hosts: %w", err)
+	}
+
+	return nil
+}
+
+// managedNames returns the names of every host, as they'd be written in
+// known_hosts.
+func (c *Config) managedNames() managedNames {
+	var managed managedNames
+
+	for _, host := range c.Hosts() {
+		if !host.Pattern {
+			managed.names = append(managed.names, host.knownHostsNames()...)
+
+			continue
+		}
+
+		// Host * would match everything, leaving nothing to prune.
+		if host.Alias != "*" {
+			managed.patterns = append(managed.patterns, host.Alias)
+		}
+	}
+
+	return managed
+}
+
+// list returns the names and patterns, sorted.
+func (m managedNames) list() []string {
+	list := slices.Concat(m.names, m.patterns)
+	slices.Sort(list)
+
+	return slices.Compact(list)
+}
+
+// records reports whether every one of the names is already listed.
+func (m managedNames) records(names []string) bool {
+	list := m.list()
+
+	for _, name := range names {
+		if !slices.Contains(list, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// prune splits the lines into those to keep and those to prune. If previous
+// is set, only lines for its names are pruned.
+func (m managedNames) prune(
+	lines []string,
+	keep []string,
+	previous *managedNames,
+) ([]string, []string) {
+	var kept, pruned []string
+
+	for _, line := range lines {
+		if m.keepLine(line, keep, previous) {
+			kept = append(kept, line)
+		} else {
+			pruned = append(pruned, line)
+		}
+	}
+
+	return kept, pruned
+}
+
+// keepLine reports whether a known_hosts line should be kept.
+func (m managedNames) keepLine(line string, keep []string, previous *managedNames) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return true
+	}
+
+	if strings.HasPrefix(fields[0], "@") {
+		if fields[0] == revokedMarker || len(fields) < 2 {
+			return true
+		}
+
+		fields = fields[1:]
+	}
+
+	names := slices.DeleteFunc(strings.Split(fields[0], ","), func(name string) bool {
+		return strings.HasPrefix(name, "!")
+	})
+
+	for _, name := range names {
+		if m.matches(name) || keeps(keep, name) {
+			return true
+		}
+	}
+
+	if previous == nil {
+		return false
+	}
+
+	// Entries for hosts that were never managed aren't ours to prune.
+	return !slices.ContainsFunc(names, previous.matches)
+}
+
+// keeps reports whether a name from known_hosts is one of the keep patterns.
+// A hashed name can only be compared with the literal host names.
+func keeps(keep []string, name string) bool {
+	if strings.HasPrefix(name, hashedHostPrefix) {
+		return slices.ContainsFunc(keep, func(kept string) bool {
+			return !strings.ContainsAny(kept, "*?") && hashMatches(name, kept)
+		})
+	}
+
+	return matchesAny(keep, name) || matchesAny(keep, hostPart(name))
+}
+
+// matches reports whether a name from known_hosts, which may be hashed or a
+// pattern, is one of the managed names.
+func (m managedNames) matches(name string) bool {
+	if strings.HasPrefix(name, hashedHostPrefix) {
+		return slices.ContainsFunc(m.names, func(managed string) bool {
+			return hashMatches(name, managed)
+		})
+	}
+
+	if strings.ContainsAny(name, "*?") {
+		return slices.ContainsFunc(m.names, func(managed string) bool {
+			return matchesAny([]string{name}, managed)
+		})
+	}
+
+	name = knownhosts.Normalize(name)
+
+	return slices.Contains(m.names, name) || matchesAny(m.patterns, hostPart(name))
+}
+
+// hashMatches reports whether a hashed known_hosts name is the hash of the
+// name.
+func hashMatches(hashed, name string) bool {
+	salt64, hash64, ok := strings.Cut(strings.TrimPrefix(hashed, hashedHostPrefix), "|")
+	if !ok {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(hash64)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(hostNameHash(salt, name), hash)
+}
+
+// matchesAny reports whether the name matches any of the patterns, which
+// use * and ? as ssh's do.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostPart returns the host of a known_hosts name, without any port.
+func hostPart(name string) string {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		return host
+	}
+
+	return name
+}
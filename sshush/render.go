@@ -0,0 +1,37 @@
+package sshush
+
+// Render produces the lines of an SSH config file from the resolved model.
+// Each group is introduced by a comment, followed by a Host block per host,
+// with the global config as a catch-all Host * block at the end.
+func Render(config *Config) []string {
+	var output []string
+
+	for _, group := range config.Groups {
+		output = append(output, "# "+group.Name)
+
+		for _, host := range group.Hosts {
+			output = append(output, "Host "+host.Alias)
+			output = appendDirectives(output, host.Directives)
+			output = append(output, "")
+		}
+	}
+
+	if len(config.Global) > 0 {
+		output = append(output, "# Global config", "Host *")
+		output = appendDirectives(output, config.Global)
+	}
+
+	return output
+}
+
+// appendDirectives appends a line to the output for each value of each
+// directive.
+func appendDirectives(output []string, directives []Directive) []string {
+	for _, directive := range directives {
+		for _, value := range directive.Values {
+			output = append(output, "    "+directive.Key+" "+value)
+		}
+	}
+
+	return output
+}
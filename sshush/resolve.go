@@ -0,0 +1,404 @@
+package sshush
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type (
+	// layer is one level of config to be merged, along with where it came
+	// from. Later layers take precedence over earlier ones.
+	layer struct {
+		origin string
+		config map[string]any
+	}
+
+	// extendedGroup is a group inherited from through Extends.
+	extendedGroup struct {
+		name   string
+		config map[string]any
+	}
+)
+
+var ErrHostNotValid = errors.New("host is not a HostName or map of config")
+
+// Resolve produces the fully resolved model from the loaded sources. This is
+// where the default, Extends, group and host level config are merged; the
+// result can then be rendered, encoded or inspected.
+func (p *Parser) Resolve() (*Config, error) {
+	global, err := p.certificateDirectives(
+		"*",
+		resolveDirectives([]layer{{OriginGlobal, p.GlobalConfig}}, false),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		SchemaVersion: ModelSchemaVersion,
+		Sources:       []string{},
+		Groups:        []Group{},
+		Global:        global,
+	}
+
+	if p.Sources != nil {
+		config.Sources = append(config.Sources, *p.Sources...)
+	}
+
+	for pair := p.UnprocessedConfig.Oldest(); pair != nil; pair = pair.Next() {
+		group, err := p.resolveGroup(pair.Key, pair.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Groups = append(config.Groups, group)
+	}
+
+	return config, nil
+}
+
+// resolveGroup resolves a single group and each of its hosts.
+// @see https://sshush.bencromwell.com/docs/configuration/groups/
+func (p *Parser) resolveGroup(identifier string, config any) (Group, error) {
+	p.debugln("Identifier: ", identifier)
+	p.debugln("Config: ", config)
+
+	configMap, ok := config.(map[string]any)
+	if !ok {
+		return Group{}, fmt.Errorf("%w: %s", ErrConfigNotMap, identifier)
+	}
+
+	// This group may have a prefix declared.
+	prefix, err := getPrefixFromConfigMap(configMap)
+	if err != nil {
+		return Group{}, err
+	}
+
+	chain := p.extendsChain(identifier, configMap)
+
+	groupLayers, err := p.groupLayers(identifier, configMap, chain)
+	if err != nil {
+		return Group{}, err
+	}
+
+	groupTags, err := p.groupTags(identifier, configMap, chain)
+	if err != nil {
+		return Group{}, err
+	}
+
+	groupKeys, err := groupHostKeys(identifier, configMap, chain, hostKeysBlock)
+	if err != nil {
+		return Group{}, err
+	}
+
+	certAuthorities, err := groupHostKeys(identifier, configMap, chain, certAuthorityBlock)
+	if err != nil {
+		return Group{}, err
+	}
+
+	group := Group{
+		Name:            identifier,
+		Prefix:          prefix,
+		Extends:         p.getExtends(configMap),
+		Source:          p.GroupSources[identifier],
+		Tags:            groupTags,
+		CertAuthorities: certAuthorities,
+		Hosts:           []Host{},
+	}
+
+	hosts, ok := configMap["Hosts"]
+	if !ok {
+		return group, nil
+	}
+
+	// If it's a direct list of hosts, rearrange things.
+	err = expandListToMapOfHosts(configMap, &hosts)
+	if err != nil {
+		return Group{}, err
+	}
+
+	hostsMap, ok := hosts.(map[string]any)
+	if !ok {
+		return Group{}, fmt.Errorf("%w: %s", ErrHostsNotListOfStrings, hosts)
+	}
+
+	// Resolve hosts in the sorted order of their keys.
+	for _, name := range sortMapByKeys(hostsMap) {
+		hostLayer, hostTags, err := getHostLayer(hostsMap[name])
+		if err != nil {
+			return Group{}, fmt.Errorf("%w: %s in %s", err, name, identifier)
+		}
+
+		hostKeys, err := getHostKeys(hostsMap[name], hostKeysBlock)
+		if err != nil {
+			return Group{}, fmt.Errorf("%w: %s in %s", err, name, identifier)
+		}
+
+		directives, err := p.certificateDirectives(
+			prefix+name,
+			resolveDirectives(slices.Concat(groupLayers, []layer{hostLayer}), true),
+		)
+		if err != nil {
+			return Group{}, fmt.Errorf("%w in %s", err, identifier)
+		}
+
+		host := Host{
+			Name:       name,
+			Alias:      prefix + name,
+			Group:      identifier,
+			Source:     group.Source,
+			Pattern:    strings.ContainsAny(name, "*?"),
+			Tags:       mergeTags(groupTags, hostTags),
+			HostKeys:   mergeTags(groupKeys, hostKeys),
+			Directives: directives,
+		}
+
+		p.debugln("Host: ", host)
+
+		group.Hosts = append(group.Hosts, host)
+	}
+
+	return group, nil
+}
+
+// groupLayers returns the layers of config that apply to the entire group:
+// the defaults, then anything inherited through Extends, then the group's
+// own config.
+func (p *Parser) groupLayers(
+	identifier string,
+	configMap map[string]any,
+	chain []extendedGroup,
+) ([]layer, error) {
+	layers := []layer{{OriginDefault, p.DefaultConfig}}
+
+	for _, extends := range chain {
+		if config, ok := extends.config["Config"].(map[string]any); ok {
+			p.debugf("Extended config %s\n", extends.name)
+			p.debugln(config)
+
+			layers = append(layers, layer{OriginExtendsPrefix + extends.name, config})
+		}
+	}
+
+	// If we have config for this specific group, add that in.
+	if config, ok := configMap["Config"]; ok {
+		groupConfig, ok := config.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s Config", ErrConfigNotMap, identifier)
+		}
+
+		layers = append(layers, layer{OriginGroup, groupConfig})
+	}
+
+	return layers, nil
+}
+
+// groupTags returns the group's own tags along with those of every group it
+// inherits from through Extends.
+func (p *Parser) groupTags(
+	identifier string,
+	configMap map[string]any,
+	chain []extendedGroup,
+) ([]string, error) {
+	tags, err := getTags(configMap)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, identifier)
+	}
+
+	for _, extends := range chain {
+		extendedTags, err := getTags(extends.config)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, extends.name)
+		}
+
+		tags = append(tags, extendedTags...)
+	}
+
+	return mergeTags(tags), nil
+}
+
+// groupHostKeys returns the keys declared under key by the group and every
+// group it inherits from through Extends. Like tags, they're sorted and
+// without duplicates.
+func groupHostKeys(
+	identifier string,
+	configMap map[string]any,
+	chain []extendedGroup,
+	key string,
+) ([]string, error) {
+	keys, err := getHostKeys(configMap, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, identifier)
+	}
+
+	for _, extends := range chain {
+		extendedKeys, err := getHostKeys(extends.config, key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, extends.name)
+		}
+
+		keys = append(keys, extendedKeys...)
+	}
+
+	return mergeTags(keys), nil
+}
+
+// extendsChain returns the groups this one inherits from through Extends,
+// outermost first. A group that has already been visited ends the chain, so
+// circular Extends declarations don't recurse forever.
+// @see https://sshush.bencromwell.com/docs/configuration/extends/
+func (p *Parser) extendsChain(identifier string, configMap map[string]any) []extendedGroup {
+	chain, circular := p.followExtends(identifier, configMap)
+	if circular != "" {
+		p.logger().Warn("circular extends", "group", circular)
+	}
+
+	return chain
+}
+
+// followExtends returns the groups this one inherits from, outermost first,
+// along with the group that made the chain circular, if any.
+func (p *Parser) followExtends(
+	identifier string,
+	configMap map[string]any,
+) ([]extendedGroup, string) {
+	var (
+		chain    []extendedGroup
+		circular string
+	)
+
+	visited := []string{identifier}
+
+	for extends := p.getExtends(configMap); extends != ""; extends = p.getExtends(configMap) {
+		if slices.Contains(visited, extends) {
+			circular = extends
+
+			break
+		}
+
+		target, ok := p.UnprocessedConfig.Get(extends)
+		if !ok {
+			break
+		}
+
+		configMap, ok = target.(map[string]any)
+		if !ok {
+			break
+		}
+
+		visited = append(visited, extends)
+		chain = append(chain, extendedGroup{name: extends, config: configMap})
+	}
+
+	slices.Reverse(chain)
+
+	return chain, circular
+}
+
+// getExtends returns the name of the group this one extends, if any.
+func (p *Parser) getExtends(configMap map[string]any) string {
+	extends, ok := configMap["Extends"]
+	if !ok {
+		return ""
+	}
+
+	extendsStr, ok := extends.(string)
+	if !ok {
+		p.logger().Warn("extends is not a string")
+
+		return ""
+	}
+
+	return extendsStr
+}
+
+// getHostLayer returns the config specific to a single host, and its tags.
+// Tags and HostKeys aren't SSH config, so are left out of the layer.
+// If the host config is a string, it's just a HostName. If the string
+// contains * it's a wildcard so has no specific HostName, and the config to
+// apply is that of the group.
+func getHostLayer(hostConfig any) (layer, []string, error) {
+	switch typedConfig := hostConfig.(type) {
+	case string:
+		if strings.Contains(typedConfig, "*") {
+			return layer{OriginHost, nil}, nil, nil
+		}
+
+		return layer{OriginHost, map[string]any{"HostName": typedConfig}}, nil, nil
+	case map[string]any:
+		tags, err := getTags(typedConfig)
+		if err != nil {
+			return layer{}, nil, err
+		}
+
+		// This copies rather than modifying the source's map.
+		config := make(map[string]any, len(typedConfig))
+
+		for key, value := range typedConfig {
+			if key != tagsBlock && key != hostKeysBlock {
+				config[key] = value
+			}
+		}
+
+		return layer{OriginHost, config}, tags, nil
+	default:
+		return layer{}, nil, ErrHostNotValid
+	}
+}
+
+// resolveDirectives merges the layers into directives. If a key is present in
+// more than one layer, the last one wins. Directives are sorted by keyword,
+// optionally with HostName hoisted to the top.
+func resolveDirectives(layers []layer, hoistHostName bool) []Directive {
+	merged := make(map[string]any)
+	origins := make(map[string]string)
+
+	for _, l := range layers {
+		for key, value := range l.config {
+			merged[key] = value
+			origins[key] = l.origin
+		}
+	}
+
+	directives := []Directive{}
+
+	if hoistHostName {
+		if hostName := merged["HostName"]; hostName != nil {
+			directives = append(directives, Directive{
+				Key:    "HostName",
+				Values: directiveValues(hostName),
+				Origin: origins["HostName"],
+			})
+		}
+
+		delete(merged, "HostName")
+	}
+
+	for _, key := range sortMapByKeys(merged) {
+		directives = append(directives, Directive{
+			Key:    key,
+			Values: directiveValues(merged[key]),
+			Origin: origins[key],
+		})
+	}
+
+	return directives
+}
+
+// directiveValues formats a config value as strings, expanding lists.
+// This essentially covers Port numbers, which we get through as ints.
+func directiveValues(value any) []string {
+	if list, ok := value.([]any); ok {
+		values := make([]string, 0, len(list))
+
+		for _, nestedValue := range list {
+			values = append(values, directiveValues(nestedValue)...)
+		}
+
+		return values
+	}
+
+	return []string{fmt.Sprintf("%v", value)}
+}
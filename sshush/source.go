@@ -0,0 +1,173 @@
+package sshush
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/adrg/frontmatter"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+	"golang.org/x/sync/errgroup"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// parsedSource is a source that has been read and parsed, but not yet
+	// interpolated or merged.
+	parsedSource struct {
+		frontMatter *SourceFrontMatter
+		config      *orderedmap.OrderedMap[string, any]
+	}
+
+	// sourceCache holds each source once it's been parsed, so that ordering
+	// and loading the sources only reads and parses each of them once.
+	sourceCache struct {
+		mu      sync.Mutex
+		sources map[string]*parsedSource
+	}
+)
+
+// get returns the parsed source, if it's been parsed.
+func (c *sourceCache) get(name string) (*parsedSource, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	source, ok := c.sources[name]
+
+	return source, ok
+}
+
+// set caches the parsed source.
+func (c *sourceCache) set(name string, source *parsedSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sources == nil {
+		c.sources = make(map[string]*parsedSource)
+	}
+
+	c.sources[name] = source
+}
+
+// delete removes the source from the cache.
+func (c *sourceCache) delete(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.sources, name)
+}
+
+// parseSources parses each of the sources that hasn't been already, at most
+// Concurrency at a time.
+func (p *Parser) parseSources(ctx context.Context, sources []string) error {
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(p.concurrency())
+
+	queued := make(map[string]bool, len(sources))
+
+	for _, source := range sources {
+		if _, ok := p.cache.get(source); ok || queued[source] {
+			continue
+		}
+
+		queued[source] = true
+
+		group.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("parsing sources: %w", err)
+			}
+
+			parsed, err := p.parseSource(ctx, source)
+			if err != nil {
+				return err
+			}
+
+			p.cache.set(source, parsed)
+
+			return nil
+		})
+	}
+
+	return group.Wait() //nolint:wrapcheck // The errors are our own, already wrapped.
+}
+
+// parseSource reads a source and parses its front matter and body.
+func (p *Parser) parseSource(ctx context.Context, source string) (*parsedSource, error) {
+	prefix, path := SplitSource(source)
+
+	var (
+		contents []byte
+		err      error
+	)
+
+	switch {
+	case IsURLSource(source):
+		contents, err = p.fetchURLSource(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+	case prefix == AnsibleSourcePrefix:
+		return p.parseAnsibleSource(source)
+	case prefix == GitSourcePrefix:
+		contents, err = readGitSource(ctx, source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrOpeningSourceFile, source, err)
+		}
+	case prefix == ExecSourcePrefix:
+		contents, err = p.runCommandSource(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		contents, err = p.readSource(source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrOpeningSourceFile, source, err)
+		}
+	}
+
+	// A command's output is often a JSON document, which the library's
+	// default formats would take as JSON front matter, leaving no body.
+	var formats []*frontmatter.Format
+	if prefix == ExecSourcePrefix || strings.EqualFold(filepath.Ext(path), ".json") {
+		formats = yamlFrontMatter()
+	}
+
+	frontMatter := &SourceFrontMatter{}
+
+	data, err := frontmatter.Parse(bytes.NewReader(contents), frontMatter, formats...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrParsingSourceFile, source, err)
+	}
+
+	config := orderedmap.New[string, any]()
+
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrParsingSourceFile, source, err)
+	}
+
+	return &parsedSource{frontMatter: frontMatter, config: config}, nil
+}
+
+// yamlFrontMatter is the YAML front matter formats alone, for sources whose
+// body may be JSON.
+func yamlFrontMatter() []*frontmatter.Format {
+	return []*frontmatter.Format{
+		frontmatter.NewFormat("---", "---", yamlv2.Unmarshal),
+		frontmatter.NewFormat("---yaml", "---", yamlv2.Unmarshal),
+	}
+}
+
+// concurrency returns how many sources may be parsed at once.
+func (p *Parser) concurrency() int {
+	if p.Concurrency > 0 {
+		return p.Concurrency
+	}
+
+	return runtime.GOMAXPROCS(0)
+}
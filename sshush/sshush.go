@@ -1,14 +1,17 @@
 package sshush
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"os"
+	"net/http"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/k0kubun/pp/v3"
 	"github.com/mongodb-forks/go-difflib/difflib"
@@ -21,11 +24,93 @@ type (
 		Sources     SSHConfigSources
 		Destination string
 		Out         io.Writer
+		// Loaded is set by Generate and Resolve to the sources that were
+		// loaded, in order, including any files they included.
+		Loaded SSHConfigSources
+		// KnownHostsFile is where the known_hosts for the host keys declared
+		// in the sources is written. Defaults to the destination with
+		// .known_hosts appended. Nothing is written to files when writing to
+		// stdout, so host keys are left out then.
+		KnownHostsFile string
+	}
+
+	// Generated is a rendered config, along with what's written alongside it.
+	Generated struct {
+		// Config is the lines of the config, including our headers.
+		Config []string
+		// KnownHosts is the known_hosts for the host keys declared in the
+		// sources, including our headers, or nil if there are none.
+		KnownHosts []string
+		// KnownHostsFile is where KnownHosts is written.
+		KnownHostsFile string
+		// ManagedHosts is the names of the hosts in the config, to add to the
+		// record for known-hosts prune, or nil if known_hosts aren't managed.
+		ManagedHosts []string
+	}
+
+	// Options control a single run. The zero value is usable: it logs to the
+	// default logger and works against the real filesystem.
+	Options struct {
+		Verbose bool
+		Debug   bool
+		DryRun  bool
+		Version string
+		// Logger receives informational output and warnings.
+		// Defaults to slog.Default().
+		Logger *slog.Logger
+		// FS is used to read and write the destination and the cache.
+		// Defaults to the OS filesystem.
+		FS FileSystem
+		// SourceFS is where the sources are read from, e.g. an embed.FS.
+		// Defaults to FS.
+		SourceFS fs.FS
+		// Stdin is read for the source "-". Defaults to os.Stdin.
+		Stdin io.Reader
+		// Now returns the current time. Defaults to time.Now.
+		Now func() time.Time
+		// Vars are interpolated into the sources as ${NAME}, taking
+		// precedence over vars in front matter and the environment.
+		Vars map[string]string
+		// LookupEnv looks up environment variables for interpolation and env
+		// conditions. Defaults to os.LookupEnv.
+		LookupEnv func(name string) (string, bool)
+		// Hostname returns the local hostname for hostname conditions.
+		// Defaults to os.Hostname.
+		Hostname func() (string, error)
+		// Concurrency is how many sources may be parsed at once.
+		// Defaults to GOMAXPROCS.
+		Concurrency int
+		// ExecTimeout is how long a command source may run for.
+		// Defaults to DefaultExecTimeout.
+		ExecTimeout time.Duration
+		// ExecCacheTTL is how long a command source's output is reused for.
+		// Output isn't cached if it's zero.
+		ExecCacheTTL time.Duration
+		// CacheDir is where command output and downloaded sources are
+		// cached, through FS. Defaults to sshush in the user's cache
+		// directory. Nothing is cached on a DryRun.
+		CacheDir string
+		// WorkingDir is the directory command sources are run in, which
+		// their cached output is keyed by. Output isn't cached without it.
+		// Defaults to the current directory.
+		WorkingDir string
+		// HTTPClient downloads URL sources. Defaults to a client with a 30
+		// second timeout.
+		HTTPClient *http.Client
+		// IncludeTags limits the hosts to those with at least one of the tags.
+		// ExcludeTags leaves out any host with one of the tags.
+		IncludeTags []string
+		ExcludeTags []string
+		// HashKnownHosts hashes the host names in the known_hosts file, as
+		// HashKnownHosts does for ssh's own.
+		HashKnownHosts bool
 	}
 )
 
 const (
 	DestinationConfigFilePermission = 0o600
+	// StdoutDestination is the destination that means write to Out.
+	StdoutDestination = "-"
 )
 
 var (
@@ -33,61 +118,258 @@ var (
 	ErrProducingConfig = errors.New("producing config")
 )
 
-func (s *Runner) Run(verbose bool, debug bool, dryRun bool, version string) error {
-	pp.SetDefaultOutput(s.Out)
+// withDefaults returns a copy of the options with any unset dependencies
+// filled in.
+func (o Options) withDefaults() Options {
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+
+	if o.FS == nil {
+		o.FS = OSFileSystem{}
+	}
+
+	if o.SourceFS == nil {
+		o.SourceFS = o.FS
+	}
+
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+
+	return o
+}
+
+// Run generates the config and writes it to the destination, or prints a
+// diff against the destination if DryRun is set. There's nothing to diff
+// against when the destination is StdoutDestination, so DryRun is ignored.
+func (s *Runner) Run(ctx context.Context, opts Options) error {
+	opts = opts.withDefaults()
+
+	generated, err := s.Generate(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun && s.Destination != StdoutDestination {
+		err = s.dryRun(opts, generated)
+		if err != nil {
+			return fmt.Errorf("dryRun: %w", err)
+		}
+
+		return nil
+	}
+
+	return s.Write(opts, generated)
+}
+
+// Generate loads the sources and renders the config, including our headers,
+// and the known_hosts to go with it, without writing anything.
+func (s *Runner) Generate(ctx context.Context, opts Options) (*Generated, error) {
+	opts = opts.withDefaults()
+
+	parser, err := s.load(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parser.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProducingConfig, err)
+	}
+
+	config = config.FilterTags(opts.IncludeTags, opts.ExcludeTags)
+
+	generated := &Generated{KnownHostsFile: s.knownHostsFile()}
+
+	generated.KnownHosts, err = s.pinHostKeys(opts, config, generated.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	manages, err := s.managesKnownHosts(opts, generated.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	if manages {
+		generated.ManagedHosts = config.managedNames().list()
+	}
+
+	generated.Config = s.processConfigLines(Render(config), opts.Version)
+
+	parser.debugln("Global config: ", parser.GlobalConfig)
+	parser.debugln("Default config: ", parser.DefaultConfig)
+
+	return generated, nil
+}
+
+// pinHostKeys returns the known_hosts for the host keys declared in the
+// sources, including our headers, and points the hosts with keys at the
+// file it'll be written to. It returns nil if there are no keys, or nowhere
+// to write them. Hashed names in the existing file are reused.
+func (s *Runner) pinHostKeys(opts Options, config *Config, file string) ([]string, error) {
+	var existing []string
+
+	if file != "" && opts.HashKnownHosts {
+		contents, err := opts.FS.ReadFile(file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+
+		existing = strings.Split(string(contents), "\n")
+	}
+
+	lines, err := config.KnownHosts(opts.HashKnownHosts, existing)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	if file == "" {
+		opts.Logger.Warn("host keys aren't written when writing the config to stdout")
+
+		return nil, nil
+	}
+
+	config.UseKnownHostsFile(file)
+
+	headers := []string{
+		"# Generated by sshush v" + opts.Version,
+		"# From " + strings.Join(s.Sources, ", "),
+	}
+
+	return slices.Concat(headers, lines), nil
+}
 
-	if verbose {
-		slog.Info(
-			"sshush v"+version+" running with",
+// knownHostsFile returns where the known_hosts is written, if anywhere.
+func (s *Runner) knownHostsFile() string {
+	if s.Destination == StdoutDestination {
+		return ""
+	}
+
+	if s.KnownHostsFile != "" {
+		return s.KnownHostsFile
+	}
+
+	return s.Destination + knownHostsSuffix
+}
+
+// Resolve loads the sources and returns the fully resolved model, for tools
+// that want the hosts rather than the rendered config. Hosts are filtered by
+// IncludeTags and ExcludeTags as they are for Generate.
+func (s *Runner) Resolve(ctx context.Context, opts Options) (*Config, error) {
+	opts = opts.withDefaults()
+
+	parser, err := s.load(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parser.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProducingConfig, err)
+	}
+
+	return config.FilterTags(opts.IncludeTags, opts.ExcludeTags), nil
+}
+
+// load orders and loads the sources into a parser.
+func (s *Runner) load(ctx context.Context, opts Options) (*Parser, error) {
+	if opts.Verbose {
+		opts.Logger.Info(
+			"sshush v"+opts.Version+" running with",
 			"sources", s.Sources,
 			"destination", s.Destination,
 		)
 	}
 
-	parser := Parser{
-		Verbose: verbose,
-		Debug:   debug,
-		DryRun:  dryRun,
+	parser := &Parser{
+		Verbose:      opts.Verbose,
+		Debug:        opts.Debug,
+		DryRun:       opts.DryRun,
+		Logger:       opts.Logger,
+		Out:          s.Out,
+		FS:           opts.SourceFS,
+		Stdin:        opts.Stdin,
+		Vars:         opts.Vars,
+		LookupEnv:    opts.LookupEnv,
+		Hostname:     opts.Hostname,
+		Concurrency:  opts.Concurrency,
+		ExecTimeout:  opts.ExecTimeout,
+		ExecCacheTTL: opts.ExecCacheTTL,
+		CacheDir:     opts.CacheDir,
+		CacheFS:      opts.FS,
+		WorkingDir:   opts.WorkingDir,
+		HTTPClient:   opts.HTTPClient,
+		Now:          opts.Now,
 	}
 
-	sources, err := parser.OrderSources(&s.Sources)
+	sources, err := parser.OrderSources(ctx, &s.Sources)
 	if err != nil {
-		return fmt.Errorf("%w: %w", ErrLoadingSources, err)
+		return nil, fmt.Errorf("%w: %w", ErrLoadingSources, err)
 	}
 
-	err = parser.Load(sources)
+	err = parser.Load(ctx, sources)
 	if err != nil {
-		return fmt.Errorf("%w: %w", ErrLoadingSources, err)
+		return nil, fmt.Errorf("%w: %w", ErrLoadingSources, err)
 	}
 
-	configLines, err := parser.ProduceConfig()
-	if err != nil {
-		return fmt.Errorf("%w: %w", ErrProducingConfig, err)
-	}
+	s.Loaded = *sources
+
+	return parser, nil
+}
 
-	if debug {
-		_, _ = pp.Println("Global config: ", parser.GlobalConfig)
-		_, _ = pp.Println("Default config: ", parser.DefaultConfig)
-		_, _ = pp.Println("Extensions: ", parser.Extensions)
+// UpToDate reports whether the destination already contains exactly the
+// generated config, and its known_hosts and record of managed hosts, if it
+// has them, are current. A missing destination is never up to date, and nor
+// is stdout.
+func (s *Runner) UpToDate(opts Options, generated *Generated) (bool, error) {
+	opts = opts.withDefaults()
+
+	if s.Destination == StdoutDestination {
+		return false, nil
 	}
 
-	newConfig := s.processConfigLines(configLines, version)
+	upToDate, err := fileContains(opts, s.Destination, generated.Config)
+	if err != nil || !upToDate {
+		return upToDate, err
+	}
 
-	if dryRun {
-		err = s.dryRun(newConfig)
+	if generated.ManagedHosts != nil {
+		recorded, err := s.readManagedHosts(opts)
 		if err != nil {
-			return fmt.Errorf("dryRun: %w", err)
+			return false, err
 		}
 
-		return nil
+		if !recorded.records(generated.ManagedHosts) {
+			return false, nil
+		}
+	}
+
+	if generated.KnownHosts == nil {
+		return true, nil
+	}
+
+	return fileContains(opts, generated.KnownHostsFile, generated.KnownHosts)
+}
+
+// fileContains reports whether the file contains exactly the lines. A
+// missing file doesn't.
+func fileContains(opts Options, file string, lines []string) (bool, error) {
+	contents, err := opts.FS.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
 	}
 
-	err = s.writeRun(verbose, newConfig)
 	if err != nil {
-		return err
+		return false, fmt.Errorf("reading %s: %w", file, err)
 	}
 
-	return nil
+	return string(contents) == joinLines(lines), nil
 }
 
 // processConfigLines applies our headers and removes spurious trailing lines.
@@ -103,81 +385,97 @@ func (s *Runner) processConfigLines(configLines []string, version string) []stri
 	return slices.Concat(headers, configLines)
 }
 
-func (s *Runner) writeRun(verbose bool, newConfig []string) error {
-	// Open but don't truncate - create if not exists, but open for read/write.
-	configFh, err := os.OpenFile(
-		s.Destination,
-		os.O_RDWR|os.O_CREATE,
-		DestinationConfigFilePermission,
-	)
-	if err != nil {
-		return fmt.Errorf("opening destination file: %w", err)
+// Write writes the generated config to the destination, backing up the
+// existing file first if it wasn't generated by sshush. If the destination
+// is StdoutDestination, the config is written to Out instead, and nothing
+// else is written. Otherwise, once the config is written, so is the generated
+// known_hosts, if any, and its hosts are added to the destination's record of
+// managed hosts.
+func (s *Runner) Write(opts Options, generated *Generated) error {
+	opts = opts.withDefaults()
+	start := opts.Now()
+
+	if s.Destination == StdoutDestination {
+		_, err := io.WriteString(s.Out, joinLines(generated.Config))
+		if err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+
+		return nil
 	}
-	defer configFh.Close()
 
 	// Check if the file has a generated by sshush header.
 	// If it wasn't, make a backup.
-	err = s.backupDestinationFileIfNotSshushGenerated(configFh)
+	err := s.backupIfNotSshushGenerated(opts, s.Destination)
 	if err != nil {
 		return fmt.Errorf("backup destination file: %w", err)
 	}
 
-	err = configFh.Truncate(0)
+	contents := joinLines(generated.Config)
+
+	err = opts.FS.WriteFile(s.Destination, []byte(contents), DestinationConfigFilePermission)
 	if err != nil {
-		return fmt.Errorf("truncating destination file: %w", err)
+		return fmt.Errorf("writing output: %w", err)
 	}
 
-	// Move the file pointer to the start.
-	_, err = configFh.Seek(0, 0)
+	// The config is written first, so that if it fails, the known_hosts it
+	// refers to is left as it was.
+	err = s.writeKnownHosts(opts, generated)
 	if err != nil {
-		return fmt.Errorf("seeking to start of file: %w", err)
+		return err
 	}
 
-	bytesWritten, err := writeLines(configFh, newConfig)
+	err = s.recordManagedHosts(opts, generated.ManagedHosts)
 	if err != nil {
-		return fmt.Errorf("writing output: %w", err)
+		return err
 	}
 
-	if verbose {
-		slog.Info(fmt.Sprintf("Wrote %d bytes to %s", bytesWritten, s.Destination))
+	if opts.Verbose {
+		opts.Logger.Info(fmt.Sprintf(
+			"Wrote %d bytes to %s in %s",
+			len(contents),
+			s.Destination,
+			opts.Now().Sub(start),
+		))
 	}
 
 	return nil
 }
 
-func (s *Runner) backupDestinationFileIfNotSshushGenerated(configFh *os.File) error {
-	// Don't bother making a backup if it was empty.
-	fileInfo, err := configFh.Stat()
+// backupIfNotSshushGenerated backs up the file, if it exists and wasn't
+// generated by sshush, before it's overwritten.
+func (s *Runner) backupIfNotSshushGenerated(opts Options, file string) error {
+	contents, err := opts.FS.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
 	if err != nil {
-		return fmt.Errorf("getting file info: %w", err)
+		return fmt.Errorf("reading %s: %w", file, err)
 	}
 
-	if fileInfo.Size() == 0 {
+	// Don't bother making a backup if it was empty.
+	if len(contents) == 0 {
 		return nil
 	}
 
-	scanner := bufio.NewScanner(configFh)
-	_ = scanner.Scan()
-	headerLine := scanner.Text()
+	headerLine, _, _ := bytes.Cut(contents, []byte("\n"))
 
-	// Reset file pointer to start.
-	_, err = configFh.Seek(0, 0)
-	if err != nil {
-		return fmt.Errorf("seeking file: %w", err)
-	}
+	if !bytes.HasPrefix(headerLine, []byte("# Generated by sshush")) {
+		description := "config"
+		if file != s.Destination {
+			description = file
+		}
 
-	if !strings.HasPrefix(headerLine, "# Generated by sshush") {
-		_, _ = pp.Println(
-			"Existing config wasn't generated by sshush. Creating a backup file: " + s.Destination + ".bak",
-		)
+		printer := pp.New()
+		printer.SetOutput(s.Out)
 
-		backupFile, err := os.Create(s.Destination + ".bak")
-		if err != nil {
-			return fmt.Errorf("creating backup file: %w", err)
-		}
-		defer backupFile.Close()
+		_, _ = printer.Println(
+			"Existing " + description + " wasn't generated by sshush. Creating a backup file: " +
+				file + ".bak",
+		)
 
-		_, err = io.Copy(backupFile, configFh)
+		err = opts.FS.WriteFile(file+".bak", contents, DestinationConfigFilePermission)
 		if err != nil {
 			return fmt.Errorf("writing backup file: %w", err)
 		}
@@ -186,20 +484,57 @@ func (s *Runner) backupDestinationFileIfNotSshushGenerated(configFh *os.File) er
 	return nil
 }
 
-func (s *Runner) dryRun(newConfig []string) error {
-	contents, err := os.ReadFile(s.Destination)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("reading destination file: %w", err)
+// writeKnownHosts writes the generated known_hosts, if there is one,
+// backing up the existing file first if it wasn't generated by sshush.
+func (s *Runner) writeKnownHosts(opts Options, generated *Generated) error {
+	if generated.KnownHosts == nil {
+		return nil
 	}
 
-	oldConfig := ""
+	file := generated.KnownHostsFile
 
-	if !os.IsNotExist(err) {
+	err := s.backupIfNotSshushGenerated(opts, file)
+	if err != nil {
+		return fmt.Errorf("backup known hosts file: %w", err)
+	}
+
+	err = opts.FS.WriteFile(
+		file,
+		[]byte(joinLines(generated.KnownHosts)),
+		DestinationConfigFilePermission,
+	)
+	if err != nil {
+		return fmt.Errorf("writing known hosts: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Runner) dryRun(opts Options, generated *Generated) error {
+	err := s.printDiff(opts, s.Destination, generated.Config)
+	if err != nil || generated.KnownHosts == nil {
+		return err
+	}
+
+	return s.printDiff(opts, generated.KnownHostsFile, generated.KnownHosts)
+}
+
+// printDiff prints a diff of the file against the lines it would be
+// replaced with.
+func (s *Runner) printDiff(opts Options, file string, newLines []string) error {
+	contents, err := opts.FS.ReadFile(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+
+	oldLines := ""
+
+	if err == nil {
 		lines := strings.Split(string(contents), "\n")
-		oldConfig = strings.Join(removeTrailingEmptyLine(lines), "\n")
+		oldLines = strings.Join(removeTrailingEmptyLine(lines), "\n")
 	}
 
-	diff, err := prettyDiff(oldConfig, strings.Join(newConfig, "\n"), s.Destination)
+	diff, err := prettyDiff(oldLines, strings.Join(newLines, "\n"), file)
 	if err != nil {
 		return fmt.Errorf("creating diff: %w", err)
 	}
@@ -232,32 +567,16 @@ func prettyDiff(oldConfig, newConfig, file string) (string, error) {
 	return diffResult, nil
 }
 
-// writeLines writes a map of lines to the file handle.
-// It returns the number of bytes written and an error, if any.
-func writeLines(fh *os.File, lines []string) (int, error) {
-	bytesWritten := 0
+// joinLines joins the lines into the contents of a file, with each line
+// terminated by a newline.
+func joinLines(lines []string) string {
+	var builder strings.Builder
 
 	for _, line := range lines {
-		nL, err := writeLine(fh, line)
-		if err != nil {
-			return bytesWritten, err
-		}
-
-		bytesWritten += nL
-	}
-
-	return bytesWritten, nil
-}
-
-// writeLine writes a line to the file handle.
-// It returns the number of bytes written and an error, if any.
-func writeLine(fh *os.File, line string) (int, error) {
-	n, err := fh.WriteString(line + "\n")
-	if err != nil {
-		return n, fmt.Errorf("writing line: %w", err)
+		builder.WriteString(line + "\n")
 	}
 
-	return n, nil
+	return builder.String()
 }
 
 // removeTrailingEmptyLine removes the last empty line from the output.
@@ -2,13 +2,37 @@ package sshush_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // known_hosts hashing is defined as HMAC-SHA1.
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/bencromwell/sshush/sshush"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gotest.tools/v3/golden"
 )
 
@@ -57,7 +81,7 @@ func TestFunctional(t *testing.T) {
 				Out:         &buf,
 			}
 
-			err := sshushRunner.Run(true, true, false, "0.0.0-dev")
+			err := sshushRunner.Run(context.Background(), sshush.Options{Verbose: true, Debug: true, Version: "0.0.0-dev"})
 			require.NoError(t, err)
 
 			generatedContents := string(golden.Get(t, testCase.destination))
@@ -75,7 +99,7 @@ func TestNoSourceFile(t *testing.T) {
 		Out:         &buf,
 	}
 
-	err := sshushRunner.Run(true, true, false, "0.0.0-dev")
+	err := sshushRunner.Run(context.Background(), sshush.Options{Verbose: true, Debug: true, Version: "0.0.0-dev"})
 	require.ErrorIs(t, err, sshush.ErrLoadingSources)
 }
 
@@ -90,7 +114,7 @@ func TestBadConfig(t *testing.T) {
 		Out:         &buf,
 	}
 
-	err := sshushRunner.Run(true, true, false, "0.0.0-dev")
+	err := sshushRunner.Run(context.Background(), sshush.Options{Verbose: true, Debug: true, Version: "0.0.0-dev"})
 	require.ErrorIs(t, err, sshush.ErrProducingConfig)
 }
 
@@ -105,7 +129,7 @@ func TestDryRun(t *testing.T) {
 		Out:         &buf,
 	}
 
-	err := sshushRunner.Run(false, false, true, "0.0.0-dev")
+	err := sshushRunner.Run(context.Background(), sshush.Options{DryRun: true, Version: "0.0.0-dev"})
 	require.NoError(t, err)
 
 	generatedDiff := buf.String()
@@ -128,7 +152,7 @@ func TestCreatesBackupFile(t *testing.T) {
 
 	backupFile := dest + ".bak"
 
-	err := sshushRunner.Run(false, false, false, "0.0.0-dev")
+	err := sshushRunner.Run(context.Background(), sshush.Options{Version: "0.0.0-dev"})
 	require.NoError(t, err)
 
 	expected := buf.String()
@@ -161,7 +185,7 @@ func TestPriorityOrder(t *testing.T) {
 		Out:         &buf,
 	}
 
-	err := sshushRunner.Run(true, true, false, "0.0.0-dev")
+	err := sshushRunner.Run(context.Background(), sshush.Options{Verbose: true, Debug: true, Version: "0.0.0-dev"})
 	require.NoError(t, err)
 
 	generatedContents := string(golden.Get(t, "prioritised.out"))
@@ -188,9 +212,1701 @@ func TestPriorityOrderWithMixedSources(t *testing.T) {
 		Out:         &buf,
 	}
 
-	err := sshushRunner.Run(true, true, false, "0.0.0-dev")
+	err := sshushRunner.Run(context.Background(), sshush.Options{Verbose: true, Debug: true, Version: "0.0.0-dev"})
 	require.NoError(t, err)
 
 	generatedContents := string(golden.Get(t, "prioritised_mixed.out"))
 	golden.Assert(t, generatedContents, "prioritised_mixed.golden")
 }
+
+// TestUpToDate checks that generating doesn't write anything, and that the
+// destination is only considered up to date once it has been written.
+func TestUpToDate(t *testing.T) {
+	var buf bytes.Buffer
+
+	sshushRunner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "aws.yml")},
+		Destination: filepath.Join(t.TempDir(), "config"),
+		Out:         &buf,
+	}
+
+	newConfig, err := sshushRunner.Generate(context.Background(), sshush.Options{Version: "0.0.0-dev"})
+	require.NoError(t, err)
+	assert.NoFileExists(t, sshushRunner.Destination)
+
+	upToDate, err := sshushRunner.UpToDate(sshush.Options{}, newConfig)
+	require.NoError(t, err)
+	assert.False(t, upToDate)
+
+	require.NoError(t, sshushRunner.Write(sshush.Options{}, newConfig))
+
+	upToDate, err = sshushRunner.UpToDate(sshush.Options{}, newConfig)
+	require.NoError(t, err)
+	assert.True(t, upToDate)
+	assert.NoFileExists(t, sshushRunner.Destination+".managed_hosts")
+}
+
+// TestEncodeConfig checks the resolved model against its documented schema.
+func TestEncodeConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		format     string
+		goldenFile string
+	}{
+		{
+			name:       "JSON",
+			source:     filepath.Join("testdata", "example.yml"),
+			format:     sshush.FormatJSON,
+			goldenFile: "example.json.golden",
+		},
+		{
+			name:       "YAML",
+			source:     filepath.Join("testdata", "ciscos2.yml"),
+			format:     sshush.FormatYAML,
+			goldenFile: "ciscos2.yaml.golden",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			sshushRunner := &sshush.Runner{
+				Sources: []string{testCase.source},
+				Out:     &buf,
+			}
+
+			config, err := sshushRunner.Resolve(context.Background(), sshush.Options{})
+			require.NoError(t, err)
+
+			var encoded bytes.Buffer
+
+			require.NoError(t, sshush.EncodeConfig(&encoded, config, testCase.format))
+			golden.Assert(t, encoded.String(), testCase.goldenFile)
+		})
+	}
+}
+
+func TestEncodeConfigUnknownFormat(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := sshush.EncodeConfig(&buf, &sshush.Config{}, "xml")
+	require.ErrorIs(t, err, sshush.ErrUnknownFormat)
+}
+
+// TestResolveExtendsChain checks that Extends is followed through more than
+// one level, and that each directive records where it came from.
+func TestResolveExtendsChain(t *testing.T) {
+	parser := &sshush.Parser{}
+
+	require.NoError(t, parser.Load(context.Background(), &sshush.SSHConfigSources{
+		filepath.Join("testdata", "extends_chain.yml"),
+	}))
+
+	config, err := parser.Resolve()
+	require.NoError(t, err)
+	require.Len(t, config.Groups, 3)
+
+	leaf := config.Groups[2]
+	require.Len(t, leaf.Hosts, 1)
+	assert.Equal(t, []sshush.Directive{
+		{Key: "HostName", Values: []string{"leaf.example.com"}, Origin: sshush.OriginHost},
+		{Key: "Port", Values: []string{"2222"}, Origin: "extends:middle"},
+		{Key: "User", Values: []string{"base"}, Origin: "extends:base"},
+	}, leaf.Hosts[0].Directives)
+}
+
+// TestResolveCircularExtends checks that circular Extends declarations end
+// rather than recursing forever.
+func TestResolveCircularExtends(t *testing.T) {
+	parser := &sshush.Parser{}
+
+	require.NoError(t, parser.Load(context.Background(), &sshush.SSHConfigSources{
+		filepath.Join("testdata", "circular.yml"),
+	}))
+
+	config, err := parser.Resolve()
+	require.NoError(t, err)
+	require.Len(t, config.Groups, 2)
+
+	for _, group := range config.Groups {
+		require.Len(t, group.Hosts, 1)
+		assert.Contains(t, group.Hosts[0].Directives, sshush.Directive{
+			Key:    "User",
+			Values: []string{group.Name},
+			Origin: sshush.OriginGroup,
+		})
+	}
+}
+
+// memFS is an in-memory sshush.FileSystem.
+type memFS struct {
+	fstest.MapFS
+}
+
+func (m memFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.MapFS[name] = &fstest.MapFile{Data: data, Mode: perm}
+
+	return nil
+}
+
+// TestRunWithOptions checks that the destination is written through the
+// injected filesystem and that logging goes to the injected logger.
+func TestRunWithOptions(t *testing.T) {
+	var buf, logs bytes.Buffer
+
+	fsys := memFS{fstest.MapFS{"config": {Data: []byte("hello\n")}}}
+
+	sshushRunner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "aws.yml")},
+		Destination: "config",
+		Out:         &buf,
+	}
+
+	err := sshushRunner.Run(context.Background(), sshush.Options{
+		Verbose:  true,
+		Version:  "0.0.0-dev",
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+		FS:       fsys,
+		SourceFS: sshush.OSFileSystem{},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("hello\n"), fsys.MapFS["config.bak"].Data)
+	assert.Contains(t, string(fsys.MapFS["config"].Data), "Host projects-aws\n")
+	assert.Contains(t, logs.String(), "Wrote")
+}
+
+func TestRunCancelled(t *testing.T) {
+	var buf bytes.Buffer
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sshushRunner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "aws.yml")},
+		Destination: filepath.Join(t.TempDir(), "config"),
+		Out:         &buf,
+	}
+
+	err := sshushRunner.Run(ctx, sshush.Options{})
+	require.ErrorIs(t, err, sshush.ErrLoadingSources)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, sshushRunner.Destination)
+}
+
+// TestSourcesFromFSAndStdin checks that sources can come from any fs.FS, and
+// that "-" reads from stdin, even though it's read twice: once to order the
+// sources and once to load them.
+func TestSourcesFromFSAndStdin(t *testing.T) {
+	var buf bytes.Buffer
+
+	sourceFS := fstest.MapFS{
+		"hosts.yml": {Data: []byte("---\npriority: 1\n---\nweb:\n  Hosts:\n    - web.example.com\n")},
+	}
+
+	sshushRunner := &sshush.Runner{
+		Sources: []string{sshush.StdinSource, "hosts.yml"},
+		Out:     &buf,
+	}
+
+	config, err := sshushRunner.Resolve(context.Background(), sshush.Options{
+		SourceFS: sourceFS,
+		Stdin:    strings.NewReader("db:\n  Hosts:\n    - db.example.com\n"),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"hosts.yml", sshush.StdinSource}, config.Sources)
+	require.Len(t, config.Groups, 2)
+	assert.Equal(t, "web", config.Groups[0].Name)
+	assert.Equal(t, "db", config.Groups[1].Name)
+	assert.Equal(t, sshush.StdinSource, config.Groups[1].Source)
+}
+
+// TestStdoutDestination checks that the config, headers included, is written
+// to Out when the destination is stdout, and that no file is created.
+func TestStdoutDestination(t *testing.T) {
+	var buf bytes.Buffer
+
+	sshushRunner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "example.yml")},
+		Destination: sshush.StdoutDestination,
+		Out:         &buf,
+	}
+
+	err := sshushRunner.Run(context.Background(), sshush.Options{Version: "0.0.0-dev"})
+	require.NoError(t, err)
+
+	golden.Assert(t, buf.String(), "example.golden")
+	assert.NoFileExists(t, sshush.StdoutDestination)
+}
+
+// TestInterpolation checks that variables come from Vars, then front matter,
+// then the environment, and that defaults and escaping work.
+func TestInterpolation(t *testing.T) {
+	var buf bytes.Buffer
+
+	sshushRunner := &sshush.Runner{
+		Sources: []string{filepath.Join("testdata", "interpolation.yml")},
+		Out:     &buf,
+	}
+
+	env := map[string]string{"DOMAIN": "example.org", "user": "from-env"}
+
+	config, err := sshushRunner.Resolve(context.Background(), sshush.Options{
+		Vars: map[string]string{"user": "ben"},
+		LookupEnv: func(name string) (string, bool) {
+			value, ok := env[name]
+
+			return value, ok
+		},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, config.Groups, 1)
+	require.Len(t, config.Groups[0].Hosts, 1)
+	assert.Equal(t, []sshush.Directive{
+		{Key: "HostName", Values: []string{"build.example.org"}, Origin: sshush.OriginHost},
+		{
+			Key:    "IdentityFile",
+			Values: []string{"~/.ssh/keys/id_ed25519"},
+			Origin: sshush.OriginDefault,
+		},
+		{Key: "ProxyJump", Values: []string{"bastion.example.com"}, Origin: sshush.OriginGroup},
+		{Key: "RemoteCommand", Values: []string{"echo ${HOME} $HOME"}, Origin: sshush.OriginGroup},
+		{Key: "User", Values: []string{"ben"}, Origin: sshush.OriginDefault},
+	}, config.Groups[0].Hosts[0].Directives)
+}
+
+func TestInterpolationUndefinedVariable(t *testing.T) {
+	var buf bytes.Buffer
+
+	sshushRunner := &sshush.Runner{
+		Sources: []string{filepath.Join("testdata", "interpolation.yml")},
+		Out:     &buf,
+	}
+
+	_, err := sshushRunner.Resolve(context.Background(), sshush.Options{
+		LookupEnv: func(string) (string, bool) { return "", false },
+	})
+	require.ErrorIs(t, err, sshush.ErrLoadingSources)
+	require.ErrorIs(t, err, sshush.ErrUndefinedVariable)
+	assert.Contains(t, err.Error(), "DOMAIN")
+}
+
+// TestInclude checks that includes are followed recursively, relative to the
+// including file, that each file is loaded once, and that included files are
+// prioritised like any other source.
+func TestInclude(t *testing.T) {
+	var buf bytes.Buffer
+
+	sshushRunner := &sshush.Runner{
+		Sources: []string{filepath.Join("testdata", "include", "entry.yml")},
+		Out:     &buf,
+	}
+
+	config, err := sshushRunner.Resolve(context.Background(), sshush.Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		filepath.Join("testdata", "include", "groups", "cache.yml"),
+		filepath.Join("testdata", "include", "common.yml"),
+		filepath.Join("testdata", "include", "groups", "db.yml"),
+		filepath.Join("testdata", "include", "entry.yml"),
+	}, config.Sources)
+
+	names := make([]string, 0, len(config.Groups))
+	for _, group := range config.Groups {
+		names = append(names, group.Name)
+	}
+
+	assert.Equal(t, []string{"cache", "base", "db", "web"}, names)
+	assert.Contains(t, config.Groups[3].Hosts[0].Directives, sshush.Directive{
+		Key:    "Port",
+		Values: []string{"2222"},
+		Origin: "extends:base",
+	})
+}
+
+func TestIncludeCycle(t *testing.T) {
+	var buf bytes.Buffer
+
+	sshushRunner := &sshush.Runner{
+		Sources: []string{filepath.Join("testdata", "include", "cycle_a.yml")},
+		Out:     &buf,
+	}
+
+	_, err := sshushRunner.Resolve(context.Background(), sshush.Options{})
+	require.ErrorIs(t, err, sshush.ErrIncludeCycle)
+}
+
+func TestIncludeGroupName(t *testing.T) {
+	sshushRunner := &sshush.Runner{
+		Sources: []string{"hosts.yml"},
+		Out:     &bytes.Buffer{},
+	}
+
+	_, err := sshushRunner.Resolve(context.Background(), sshush.Options{
+		SourceFS: fstest.MapFS{"hosts.yml": {Data: []byte(
+			"include:\n  Hosts:\n    web-1: 10.0.0.1\n",
+		)}},
+	})
+	require.ErrorIs(t, err, sshush.ErrIncludeIsGroup)
+}
+
+// TestTags checks that tags are inherited through Extends and that hosts are
+// filtered by them.
+func TestTags(t *testing.T) {
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "tags.yml")},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	config, err := runner.Resolve(context.Background(), sshush.Options{})
+	require.NoError(t, err)
+	require.Len(t, config.Groups, 3)
+
+	assert.Equal(t, []string{"db", "eu", "primary", "prod", "staging"}, config.Tags())
+
+	prod := config.Groups[1]
+	assert.Equal(t, []string{"db", "eu", "prod"}, prod.Tags)
+	require.Len(t, prod.Hosts, 2)
+	assert.Equal(t, []string{"db", "eu", "prod"}, prod.Hosts[0].Tags)
+	assert.Equal(t, []string{"db", "eu", "primary", "prod"}, prod.Hosts[1].Tags)
+	assert.Equal(t, []sshush.Directive{
+		{Key: "HostName", Values: []string{"db2.example.com"}, Origin: sshush.OriginHost},
+		{Key: "User", Values: []string{"postgres"}, Origin: "extends:databases"},
+	}, prod.Hosts[1].Directives)
+
+	config, err = runner.Resolve(context.Background(), sshush.Options{
+		IncludeTags: []string{"db", "staging"},
+		ExcludeTags: []string{"primary"},
+	})
+	require.NoError(t, err)
+
+	var aliases []string
+
+	for _, group := range config.Groups {
+		for _, host := range group.Hosts {
+			aliases = append(aliases, host.Alias)
+		}
+	}
+
+	assert.Equal(t, []string{"db1", "stage.example.com"}, aliases)
+	assert.Equal(t, "databases", config.Groups[0].Name, "groups without hosts are kept")
+}
+
+// TestSearchHosts checks that substring matches come before fuzzy ones.
+func TestSearchHosts(t *testing.T) {
+	hosts := []sshush.Host{
+		{Alias: "prod-db1", Group: "databases"},
+		{Alias: "pdb", Group: "other"},
+		{Alias: "web", Group: "web_servers", Directives: []sshush.Directive{
+			{Key: "HostName", Values: []string{"web.pdb.example.com"}},
+		}},
+		{Alias: "cache", Group: "caches"},
+	}
+
+	var aliases []string
+
+	for _, host := range sshush.SearchHosts(hosts, "PDB") {
+		aliases = append(aliases, host.Alias)
+	}
+
+	assert.Equal(t, []string{"pdb", "web", "prod-db1"}, aliases)
+	assert.Len(t, sshush.SearchHosts(hosts, ""), len(hosts))
+	assert.Empty(t, sshush.SearchHosts(hosts, "bdp"))
+}
+
+// TestListHosts checks the table of hosts.
+func TestListHosts(t *testing.T) {
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "tags.yml")},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	config, err := runner.Resolve(context.Background(), sshush.Options{})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	require.NoError(t, sshush.ListHosts(&buf, config.Hosts(), sshush.FormatTable))
+	golden.Assert(t, buf.String(), "tags_list.golden")
+}
+
+// TestSourceConditions checks that disabled sources, and those whose
+// conditions aren't met, are skipped.
+func TestSourceConditions(t *testing.T) {
+	sources, err := filepath.Glob(filepath.Join("testdata", "conditions", "*.yml"))
+	require.NoError(t, err)
+
+	runner := &sshush.Runner{
+		Sources:     sources,
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	config, err := runner.Resolve(context.Background(), sshush.Options{
+		Hostname:  func() (string, error) { return "work-laptop", nil },
+		LookupEnv: func(string) (string, bool) { return "", false },
+	})
+	require.NoError(t, err)
+
+	var groups []string
+
+	for _, group := range config.Groups {
+		groups = append(groups, group.Name)
+	}
+
+	assert.Equal(t, []string{"base", "marker", "needs", "work"}, groups)
+}
+
+// TestSourceRequiresMissing checks that a source requiring another that isn't
+// loaded is an error.
+func TestSourceRequiresMissing(t *testing.T) {
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "conditions", "needs.yml")},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	_, err := runner.Resolve(context.Background(), sshush.Options{})
+	require.ErrorIs(t, err, sshush.ErrRequiredSourceNotFound)
+}
+
+// TestPriorityBands checks that negative priorities come after unprioritised
+// sources, that last comes last, and that ties are broken by file name.
+func TestPriorityBands(t *testing.T) {
+	source := func(priority string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte("---\npriority: " + priority + "\n---\n")}
+	}
+
+	parser := &sshush.Parser{FS: fstest.MapFS{
+		"a.yml":     source("-1"),
+		"b.yml":     source("last"),
+		"c.yml":     source("5"),
+		"x/d.yml":   source("5"),
+		"e.yml":     {Data: []byte("e: {}\n")},
+		"f.yml":     source("-2"),
+		"z.yml":     {Data: []byte("z: {}\n")},
+		"aaaa.yml":  source("last"),
+		"bogus.yml": source("soon"),
+	}}
+
+	ordered, err := parser.OrderSources(context.Background(), &sshush.SSHConfigSources{
+		"b.yml", "z.yml", "e.yml", "f.yml", "x/d.yml", "a.yml", "c.yml", "aaaa.yml",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &sshush.SSHConfigSources{
+		"c.yml", "x/d.yml", "z.yml", "e.yml", "f.yml", "a.yml", "aaaa.yml", "b.yml",
+	}, ordered)
+
+	_, err = parser.OrderSources(context.Background(), &sshush.SSHConfigSources{"bogus.yml"})
+	require.ErrorIs(t, err, sshush.ErrInvalidPriority)
+}
+
+// TestLoadConcurrently checks that the output doesn't depend on how many
+// sources are parsed at once.
+func TestLoadConcurrently(t *testing.T) {
+	sources := writeHostsFixture(t, t.TempDir(), 20, 10)
+
+	generate := func(concurrency int) []string {
+		runner := &sshush.Runner{Sources: sources, Out: &bytes.Buffer{}}
+
+		config, err := runner.Generate(context.Background(), sshush.Options{Concurrency: concurrency})
+		require.NoError(t, err)
+
+		return config.Config
+	}
+
+	serial := generate(1)
+	assert.Contains(t, serial, "Host host-19-9")
+
+	for range 5 {
+		assert.Equal(t, serial, generate(8))
+	}
+}
+
+// BenchmarkGenerate generates the config for 10,000 hosts spread across 100
+// sources, parsing the sources one at a time and concurrently.
+func BenchmarkGenerate(b *testing.B) {
+	sources := writeHostsFixture(b, b.TempDir(), 100, 100)
+
+	for _, concurrency := range []int{1, 0} {
+		name := "concurrency=default"
+		if concurrency > 0 {
+			name = "concurrency=" + strconv.Itoa(concurrency)
+		}
+
+		b.Run(name, func(b *testing.B) {
+			runner := &sshush.Runner{Sources: sources, Out: &bytes.Buffer{}}
+			opts := sshush.Options{
+				Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Concurrency: concurrency,
+			}
+
+			for range b.N {
+				_, err := runner.Generate(context.Background(), opts)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// writeHostsFixture writes sources with a group of hosts each, and returns
+// their paths. Each source has a priority, so that they're ordered.
+func writeHostsFixture(tb testing.TB, dir string, sources, hostsPerSource int) []string {
+	tb.Helper()
+
+	paths := make([]string, 0, sources)
+
+	for i := range sources {
+		var builder strings.Builder
+
+		fmt.Fprintf(&builder, "---\npriority: %d\n---\ngroup_%d:\n  Config:\n    User: user%d\n  Hosts:\n", i+1, i, i)
+
+		for j := range hostsPerSource {
+			fmt.Fprintf(&builder, "    host-%d-%d:\n      HostName: 10.%d.%d.1\n      Port: 22\n", i, j, i, j)
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("source_%03d.yml", i))
+		require.NoError(tb, os.WriteFile(path, []byte(builder.String()), 0o600))
+
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+// TestAnsibleInventory checks that INI and YAML inventories produce the same
+// config, merged with a regular source that overrides one of their groups.
+func TestAnsibleInventory(t *testing.T) {
+	for _, inventory := range []string{"hosts.ini", "hosts.yml"} {
+		goldenFile := "ansible_" + strings.TrimPrefix(filepath.Ext(inventory), ".") + ".golden"
+
+		t.Run(inventory, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			runner := &sshush.Runner{
+				Sources: []string{
+					sshush.AnsibleSourcePrefix + filepath.Join("testdata", "ansible", inventory),
+					filepath.Join("testdata", "ansible", "overrides.yml"),
+				},
+				Destination: sshush.StdoutDestination,
+				Out:         &buf,
+			}
+
+			config, err := runner.Generate(context.Background(), sshush.Options{})
+			require.NoError(t, err)
+
+			// Skip the header, which names the sources.
+			golden.Assert(t, strings.Join(config.Config[3:], "\n")+"\n", goldenFile)
+		})
+	}
+}
+
+// TestAnsibleInventoryInvalid checks that a bad host range is reported.
+func TestAnsibleInventoryInvalid(t *testing.T) {
+	parser := &sshush.Parser{FS: fstest.MapFS{
+		"hosts": {Data: []byte("[web]\nweb[01:x]\n")},
+	}}
+
+	err := parser.Load(context.Background(), &sshush.SSHConfigSources{"ansible:hosts"})
+	require.ErrorIs(t, err, sshush.ErrInvalidHostRange)
+}
+
+// TestEncodeAnsibleInventory checks the INI and YAML inventories, and that
+// reading them back as a source gives the same hosts.
+func TestEncodeAnsibleInventory(t *testing.T) {
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "tags.yml")},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	config, err := runner.Resolve(context.Background(), sshush.Options{})
+	require.NoError(t, err)
+
+	for _, format := range []string{sshush.FormatINI, sshush.FormatYAML} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			require.NoError(t, sshush.EncodeAnsibleInventory(&buf, config, format))
+			golden.Assert(t, buf.String(), "tags_inventory."+format+".golden")
+
+			parser := &sshush.Parser{FS: fstest.MapFS{
+				"inventory." + format: {Data: buf.Bytes()},
+			}}
+
+			require.NoError(t, parser.Load(context.Background(), &sshush.SSHConfigSources{
+				sshush.AnsibleSourcePrefix + "inventory." + format,
+			}))
+
+			imported, err := parser.Resolve()
+			require.NoError(t, err)
+
+			for _, host := range config.Hosts() {
+				i := slices.IndexFunc(imported.Hosts(), func(h sshush.Host) bool {
+					return h.Alias == host.Alias
+				})
+				require.NotEqual(t, -1, i, host.Alias)
+				assert.Equal(t, host.Value("HostName"), imported.Hosts()[i].Value("HostName"))
+				assert.Equal(t, host.Value("User"), imported.Hosts()[i].Value("User"))
+			}
+		})
+	}
+}
+
+// TestEncodeAnsibleInventoryQuotes checks that a value with both kinds of
+// quote in survives being exported to INI and imported again.
+func TestEncodeAnsibleInventoryQuotes(t *testing.T) {
+	const keyFile = `~/.ssh/o'brien"s_key`
+
+	runner := &sshush.Runner{
+		Sources:     []string{"hosts.yml"},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	config, err := runner.Resolve(context.Background(), sshush.Options{
+		SourceFS: fstest.MapFS{"hosts.yml": {Data: []byte(`web:
+  Hosts:
+    web-1:
+      HostName: 10.0.0.1
+      IdentityFile: ` + keyFile + `
+`)}},
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+
+	require.NoError(t, sshush.EncodeAnsibleInventory(&buf, config, sshush.FormatINI))
+	assert.Contains(t, buf.String(), `ansible_ssh_private_key_file="~/.ssh/o'brien\"s_key"`)
+
+	parser := &sshush.Parser{FS: fstest.MapFS{"inventory.ini": {Data: buf.Bytes()}}}
+
+	require.NoError(t, parser.Load(context.Background(), &sshush.SSHConfigSources{
+		sshush.AnsibleSourcePrefix + "inventory.ini",
+	}))
+
+	imported, err := parser.Resolve()
+	require.NoError(t, err)
+	require.Len(t, imported.Hosts(), 1)
+	assert.Equal(t, keyFile, imported.Hosts()[0].Value("IdentityFile"))
+}
+
+// TestTerraformState checks that hosts are read from Terraform state, that
+// the group's own hosts take precedence, and that instances without a
+// HostName are skipped.
+func TestTerraformState(t *testing.T) {
+	var buf bytes.Buffer
+
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "terraform", "terraform.yml")},
+		Destination: sshush.StdoutDestination,
+		Out:         &buf,
+	}
+
+	config, err := runner.Generate(context.Background(), sshush.Options{
+		Logger: slog.New(slog.NewTextHandler(&buf, nil)),
+	})
+	require.NoError(t, err)
+
+	golden.Assert(t, strings.Join(config.Config[3:], "\n")+"\n", "terraform.golden")
+	assert.Contains(t, buf.String(), "host=web-3")
+}
+
+func TestJSONInventory(t *testing.T) {
+	var buf bytes.Buffer
+
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "inventory", "inventory.yml")},
+		Destination: sshush.StdoutDestination,
+		Out:         &buf,
+	}
+
+	config, err := runner.Generate(context.Background(), sshush.Options{
+		Logger: slog.New(slog.NewTextHandler(&buf, nil)),
+	})
+	require.NoError(t, err)
+
+	golden.Assert(t, strings.Join(config.Config[3:], "\n")+"\n", "inventory.golden")
+	assert.Contains(t, buf.String(), "skipping item without an alias or HostName")
+}
+
+// TestJSONInventoryQuery checks that a JMESPath query can filter the items,
+// and that an invalid one is reported.
+func TestJSONInventoryQuery(t *testing.T) {
+	servers, err := os.ReadFile(filepath.Join("testdata", "inventory", "servers.json"))
+	require.NoError(t, err)
+
+	source := func(items string) fstest.MapFS {
+		return fstest.MapFS{
+			"servers.json": {Data: servers},
+			"hosts.yml": {Data: []byte(`droplets:
+  JSON:
+    File: servers.json
+    Items: "` + items + `"
+    Alias: name
+    HostName: networks.v4[0].ip_address
+`)},
+		}
+	}
+
+	parser := &sshush.Parser{FS: source("servers[?status == 'archived']")}
+	require.NoError(t, parser.Load(context.Background(), &sshush.SSHConfigSources{"hosts.yml"}))
+
+	config, err := parser.Resolve()
+	require.NoError(t, err)
+	require.Len(t, config.Hosts(), 1)
+	assert.Equal(t, "old-logs", config.Hosts()[0].Alias)
+	assert.Equal(t, "198.51.100.9", config.Hosts()[0].Value("HostName"))
+
+	parser = &sshush.Parser{FS: source("servers[?status ==")}
+	err = parser.Load(context.Background(), &sshush.SSHConfigSources{"hosts.yml"})
+	require.ErrorIs(t, err, sshush.ErrJSONQuery)
+}
+
+// TestProviderDuplicateAliases checks that a host whose alias is already
+// taken is skipped with a warning naming both, rather than replacing the
+// first.
+func TestProviderDuplicateAliases(t *testing.T) {
+	tests := map[string]struct {
+		file   string
+		data   string
+		block  string
+		second string
+	}{
+		"terraform": {
+			file: "terraform.tfstate",
+			data: `{"version": 4, "resources": [{
+  "mode": "managed", "type": "aws_instance", "name": "web",
+  "instances": [
+    {"index_key": 0, "attributes": {"name": "web", "ip": "10.0.0.1"}},
+    {"index_key": 1, "attributes": {"name": "web", "ip": "10.0.0.2"}}
+  ]
+}]}`,
+			block:  "Terraform:\n    State: terraform.tfstate\n    Alias: name\n    HostName: ip\n",
+			second: "aws_instance.web[1]",
+		},
+		"json": {
+			file:   "servers.json",
+			data:   `[{"name": "web", "ip": "10.0.0.1"}, {"name": "web", "ip": "10.0.0.2"}]`,
+			block:  "JSON:\n    File: servers.json\n    Alias: name\n    HostName: ip\n",
+			second: "10.0.0.2",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			parser := &sshush.Parser{
+				Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+				FS: fstest.MapFS{
+					tt.file:     {Data: []byte(tt.data)},
+					"hosts.yml": {Data: []byte("servers:\n  " + tt.block)},
+				},
+			}
+			require.NoError(t, parser.Load(context.Background(), &sshush.SSHConfigSources{"hosts.yml"}))
+
+			config, err := parser.Resolve()
+			require.NoError(t, err)
+			require.Len(t, config.Hosts(), 1)
+			assert.Equal(t, "10.0.0.1", config.Hosts()[0].Value("HostName"))
+			assert.Contains(t, logs.String(), "same alias as another")
+			assert.Contains(t, logs.String(), tt.second)
+		})
+	}
+}
+
+// TestExtensions checks that the deprecated Extensions still has each
+// group's config merged with that of the groups it extends.
+func TestExtensions(t *testing.T) {
+	parser := &sshush.Parser{FS: fstest.MapFS{"hosts.yml": {Data: []byte(`base:
+  Config:
+    User: base
+    Port: 2222
+web:
+  Extends: base
+  Config:
+    User: web
+  Hosts:
+    web-1: 10.0.0.1
+db:
+  Hosts:
+    db-1: 10.0.1.1
+`)}}}
+	require.NoError(t, parser.Load(context.Background(), &sshush.SSHConfigSources{"hosts.yml"}))
+
+	//nolint:staticcheck // Checking the deprecated field still works.
+	assert.Equal(t, map[string]sshush.ExtendsConfig{
+		"base": {Identifier: "base", Config: map[string]any{"User": "base", "Port": 2222}},
+		"web": {
+			Identifier: "web",
+			Config:     map[string]any{"User": "web", "Port": 2222},
+			Extends:    "base",
+		},
+	}, parser.Extensions)
+}
+
+func TestExecSource(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "inventory.sh")
+
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo run >> "`+counter+`"
+cat <<YAML
+---
+servers:
+  Config:
+    User: $1
+  Hosts:
+    app-1: 10.0.0.1
+YAML
+`), 0o700)
+	require.NoError(t, err)
+
+	runner := &sshush.Runner{
+		Sources:     []string{sshush.ExecSourcePrefix + script + " deploy"},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	opts := sshush.Options{
+		ExecCacheTTL: time.Hour,
+		CacheDir:     filepath.Join(dir, "cache"),
+		WorkingDir:   dir,
+	}
+
+	for range 2 {
+		config, err := runner.Generate(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Contains(t, config.Config, "Host app-1")
+		assert.Contains(t, config.Config, "    User deploy")
+	}
+
+	runs, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	assert.Equal(t, "run\n", string(runs), "cached output is reused within the TTL")
+
+	opts.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	_, err = runner.Generate(context.Background(), opts)
+	require.NoError(t, err)
+
+	runs, err = os.ReadFile(counter)
+	require.NoError(t, err)
+	assert.Equal(t, "run\nrun\n", string(runs), "the command runs again once the TTL expires")
+}
+
+// TestExecSourceCacheFS checks that command output is cached through the
+// injected filesystem, and not at all on a dry run.
+func TestExecSourceCacheFS(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "inventory.sh")
+
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho 'servers: {Hosts: {app-1: 10.0.0.1}}'\n"), 0o700)
+	require.NoError(t, err)
+
+	for _, dryRun := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dry run %t", dryRun), func(t *testing.T) {
+			fsys := memFS{fstest.MapFS{}}
+
+			runner := &sshush.Runner{
+				Sources:     []string{sshush.ExecSourcePrefix + script},
+				Destination: "config",
+				Out:         &bytes.Buffer{},
+			}
+
+			err := runner.Run(context.Background(), sshush.Options{
+				FS:           fsys,
+				SourceFS:     sshush.OSFileSystem{},
+				DryRun:       dryRun,
+				ExecCacheTTL: time.Hour,
+				CacheDir:     "cache",
+				WorkingDir:   dir,
+			})
+			require.NoError(t, err)
+
+			cached, err := fs.Glob(fsys, "cache/exec-*")
+			require.NoError(t, err)
+			assert.Equal(t, !dryRun, len(cached) == 1)
+		})
+	}
+}
+
+func TestExecSourceJSON(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "inventory.sh")
+
+	// Pretty printed, as jq would, so the document starts with a lone "{".
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+cat <<JSON
+{
+  "servers": {
+    "Config": {"User": "deploy"},
+    "Hosts": {"app-1": "10.0.0.1"}
+  }
+}
+JSON
+`), 0o700)
+	require.NoError(t, err)
+
+	runner := &sshush.Runner{
+		Sources:     []string{sshush.ExecSourcePrefix + script},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	config, err := runner.Generate(context.Background(), sshush.Options{})
+	require.NoError(t, err)
+	assert.Contains(t, config.Config, "Host app-1")
+	assert.Contains(t, config.Config, "    HostName 10.0.0.1")
+	assert.Contains(t, config.Config, "    User deploy")
+}
+
+// TestFrontMatterFormats checks that file sources still take TOML and JSON
+// front matter, and that a JSON source isn't taken as front matter.
+func TestFrontMatterFormats(t *testing.T) {
+	const body = "web:\n  Config:\n    User: ${user}\n  Hosts:\n    web-1: 10.0.0.1\n"
+
+	tests := map[string]string{
+		"hosts.yml":      "---\nvars:\n  user: deploy\n---\n" + body,
+		"hosts.toml.yml": "+++\n[vars]\nuser = \"deploy\"\n+++\n" + body,
+		"hosts.json.yml": ";;;\n{\"vars\": {\"user\": \"deploy\"}}\n;;;\n" + body,
+		"hosts.json": `{
+  "web": {
+    "Config": {"User": "deploy"},
+    "Hosts": {"web-1": "10.0.0.1"}
+  }
+}
+`,
+	}
+
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			runner := &sshush.Runner{
+				Sources:     []string{name},
+				Destination: sshush.StdoutDestination,
+				Out:         &bytes.Buffer{},
+			}
+
+			generated, err := runner.Generate(context.Background(), sshush.Options{
+				SourceFS: fstest.MapFS{name: {Data: []byte(contents)}},
+			})
+			require.NoError(t, err)
+			assert.Contains(t, generated.Config, "Host web-1")
+			assert.Contains(t, generated.Config, "    User deploy")
+		})
+	}
+}
+
+func TestExecSourceFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		want    string
+	}{
+		{
+			name:   "stderr",
+			script: "#!/bin/sh\necho 'inventory unavailable' >&2\nexit 3\n",
+			want:   "exit status 3: inventory unavailable",
+		},
+		{
+			name:    "timeout",
+			script:  "#!/bin/sh\nexec sleep 5\n",
+			timeout: 50 * time.Millisecond,
+			want:    "timed out after 50ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := filepath.Join(t.TempDir(), "inventory.sh")
+			require.NoError(t, os.WriteFile(script, []byte(tt.script), 0o700))
+
+			runner := &sshush.Runner{
+				Sources:     []string{sshush.ExecSourcePrefix + script},
+				Destination: sshush.StdoutDestination,
+				Out:         &bytes.Buffer{},
+			}
+
+			_, err := runner.Generate(context.Background(), sshush.Options{
+				ExecTimeout: tt.timeout,
+			})
+			require.ErrorIs(t, err, sshush.ErrRunningCommand)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestURLSource(t *testing.T) {
+	const body = "---\nshared:\n  Hosts:\n    jump: jump.example.com\n"
+
+	var notModified int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ssh.yml" {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, body)
+	}))
+
+	sum := sha256.Sum256([]byte(body))
+	checksum := hex.EncodeToString(sum[:])
+
+	var logs bytes.Buffer
+
+	opts := sshush.Options{
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+		CacheDir: t.TempDir(),
+	}
+
+	generate := func(source string) ([]string, error) {
+		runner := &sshush.Runner{
+			Sources:     []string{source},
+			Destination: sshush.StdoutDestination,
+			Out:         &bytes.Buffer{},
+		}
+
+		generated, err := runner.Generate(context.Background(), opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return generated.Config, nil
+	}
+
+	for range 2 {
+		config, err := generate(server.URL + "/ssh.yml#sha256=" + checksum)
+		require.NoError(t, err)
+		assert.Contains(t, config, "Host jump")
+	}
+
+	assert.Equal(t, 1, notModified, "the second request is conditional")
+
+	_, err := generate(server.URL + "/ssh.yml#sha256=" + strings.Repeat("0", len(checksum)))
+	require.ErrorIs(t, err, sshush.ErrChecksumMismatch)
+
+	_, err = generate(server.URL + "/missing.yml")
+	require.ErrorIs(t, err, sshush.ErrFetchingSource)
+	assert.Contains(t, err.Error(), "404 Not Found")
+
+	server.Close()
+
+	config, err := generate(server.URL + "/ssh.yml")
+	require.NoError(t, err, "the cached copy is used when offline")
+	assert.Contains(t, config, "Host jump")
+	assert.Contains(t, logs.String(), "using cached source")
+
+	_, err = generate(server.URL + "/missing.yml")
+	require.ErrorIs(t, err, sshush.ErrFetchingSource, "there's nothing cached to fall back to")
+}
+
+func TestGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	repo := t.TempDir()
+
+	git := func(args ...string) {
+		t.Helper()
+
+		cmd := exec.Command("git", append([]string{
+			"-C", repo, "-c", "user.name=sshush", "-c", "user.email=sshush@example.com",
+		}, args...)...)
+
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+
+	commit := func(files map[string]string, tag string) {
+		t.Helper()
+
+		for name, contents := range files {
+			name = filepath.Join(repo, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+			require.NoError(t, os.WriteFile(name, []byte(contents), 0o600))
+		}
+
+		git("add", "-A")
+		git("commit", "-q", "-m", tag)
+		git("tag", tag)
+	}
+
+	git("init", "-q")
+	commit(map[string]string{
+		"common.yml":       "---\nglobal:\n  ServerAliveInterval: 30\n",
+		"groups/web.yml":   "---\ninclude: [../common.yml]\n---\nweb:\n  Hosts:\n    web-1: 10.0.0.1\n",
+		"groups/db.yml":    "---\ndb:\n  Hosts:\n    db-1: 10.0.1.1\n",
+		"groups/notes.txt": "not a source\n",
+		"cloud.yml": "---\ncloud:\n  JSON:\n    File: inventory/servers.json\n" +
+			"    Alias: name\n    HostName: ip\n",
+		"inventory/servers.json": `[{"name": "app-1", "ip": "10.0.2.1"}]`,
+	}, "v1")
+	commit(map[string]string{
+		"groups/web.yml": "---\nweb:\n  Hosts:\n    web-2: 10.0.0.2\n",
+	}, "v2")
+
+	// The working tree doesn't matter, only the ref.
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "groups", "db.yml"), []byte("nonsense"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "inventory", "servers.json"), []byte("nonsense"), 0o600))
+
+	sources, err := sshush.ExpandGitSource(
+		context.Background(),
+		sshush.GitSourcePrefix+repo+"//groups/*.yml?ref=v1",
+	)
+	require.NoError(t, err)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = sshush.ExpandGitSource(cancelled, sshush.GitSourcePrefix+repo+"//groups/*.yml?ref=v1")
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []string{
+		sshush.GitSourcePrefix + repo + "//groups/db.yml?ref=v1",
+		sshush.GitSourcePrefix + repo + "//groups/web.yml?ref=v1",
+	}, sources)
+
+	generate := func(sources []string) []string {
+		t.Helper()
+
+		runner := &sshush.Runner{
+			Sources:     sources,
+			Destination: sshush.StdoutDestination,
+			Out:         &bytes.Buffer{},
+		}
+
+		config, err := runner.Generate(context.Background(), sshush.Options{})
+		require.NoError(t, err)
+
+		return config.Config
+	}
+
+	v1 := generate(sources)
+	assert.Contains(t, v1, "Host web-1")
+	assert.Contains(t, v1, "Host db-1")
+	assert.Contains(t, v1, "    ServerAliveInterval 30", "includes are read from the same ref")
+
+	cloud := generate([]string{sshush.GitSourcePrefix + repo + "//cloud.yml?ref=v1"})
+	assert.Contains(t, cloud, "Host app-1", "provider files are read from the same ref")
+
+	v2 := generate([]string{sshush.GitSourcePrefix + repo + "//groups/web.yml?ref=v2"})
+	assert.Contains(t, v2, "Host web-2")
+	assert.NotContains(t, v2, "Host web-1")
+
+	runner := &sshush.Runner{
+		Sources:     []string{sshush.GitSourcePrefix + repo + "//groups/web.yml?ref=v9"},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	_, err = runner.Generate(context.Background(), sshush.Options{})
+	require.ErrorIs(t, err, sshush.ErrReadingGit)
+}
+
+func TestGitSourceInvalidRef(t *testing.T) {
+	_, err := sshush.ExpandGitSource(
+		context.Background(),
+		sshush.GitSourcePrefix+"/srv/configs.git//groups/*.yml?ref=--output=/tmp/x",
+	)
+	require.ErrorIs(t, err, sshush.ErrInvalidGitSource)
+}
+
+func TestKnownHosts(t *testing.T) {
+	fsys := memFS{fstest.MapFS{}}
+
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "known_hosts", "hosts.yml")},
+		Destination: "config",
+		Out:         &bytes.Buffer{},
+	}
+
+	err := runner.Run(context.Background(), sshush.Options{
+		FS:       fsys,
+		SourceFS: sshush.OSFileSystem{},
+	})
+	require.NoError(t, err)
+
+	config := string(fsys.MapFS["config"].Data)
+	knownHosts := string(fsys.MapFS["config.known_hosts"].Data)
+
+	golden.Assert(t, config+"\n"+knownHosts, "known_hosts.golden")
+}
+
+// TestKnownHostsStdout checks that nothing is written to files when the
+// config goes to stdout, even with a known hosts file set.
+func TestKnownHostsStdout(t *testing.T) {
+	var out, logs bytes.Buffer
+
+	fsys := memFS{fstest.MapFS{}}
+
+	runner := &sshush.Runner{
+		Sources:        []string{filepath.Join("testdata", "known_hosts", "hosts.yml")},
+		Destination:    sshush.StdoutDestination,
+		KnownHostsFile: "known_hosts",
+		Out:            &out,
+	}
+
+	err := runner.Run(context.Background(), sshush.Options{
+		FS:       fsys,
+		SourceFS: sshush.OSFileSystem{},
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	require.NoError(t, err)
+
+	assert.Empty(t, fsys.MapFS)
+	assert.Contains(t, out.String(), "Host router-1")
+	assert.NotContains(t, out.String(), "UserKnownHostsFile known_hosts")
+	assert.Contains(t, logs.String(), "host keys aren't written")
+}
+
+// TestKnownHostsHashed checks that hashed names are salted at random, that
+// ssh can still find the hosts in them, and that they're reused when the file
+// is written again rather than changing each time.
+func TestKnownHostsHashed(t *testing.T) {
+	generate := func(fsys memFS) string {
+		t.Helper()
+
+		runner := &sshush.Runner{
+			Sources:     []string{filepath.Join("testdata", "known_hosts", "hosts.yml")},
+			Destination: "config",
+			Out:         &bytes.Buffer{},
+		}
+
+		err := runner.Run(context.Background(), sshush.Options{
+			FS:             fsys,
+			SourceFS:       sshush.OSFileSystem{},
+			HashKnownHosts: true,
+		})
+		require.NoError(t, err)
+
+		return string(fsys.MapFS["config.known_hosts"].Data)
+	}
+
+	fsys := memFS{fstest.MapFS{}}
+	hashed := generate(fsys)
+
+	assert.Equal(t, hashed, generate(fsys), "existing hashes are reused")
+	assert.NotEqual(t, hashed, generate(memFS{fstest.MapFS{}}), "salts are random")
+
+	assert.NotContains(t, hashed, "router-1")
+	assert.Contains(t, hashed, "\n*.routers.example.com ", "patterns aren't hashed")
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(file, []byte(hashed), 0o600))
+
+	callback, err := knownhosts.New(file)
+	require.NoError(t, err)
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAHcJnU3wz+MwNi5w6R57jhDLRt6vKlyMCxVvZO7DcXd",
+	))
+	require.NoError(t, err)
+
+	for _, name := range []string{"router-1:22", "router-1.example.com:22"} {
+		addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+		assert.NoError(t, callback(name, addr, key), name)
+	}
+}
+
+func TestKnownHostsInvalidKey(t *testing.T) {
+	runner := &sshush.Runner{
+		Sources:     []string{"hosts.yml"},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	_, err := runner.Generate(context.Background(), sshush.Options{
+		SourceFS: fstest.MapFS{"hosts.yml": {Data: []byte(
+			"web:\n  Hosts:\n    web-1:\n      HostKeys: ssh-ed25519 not-base64\n",
+		)}},
+	})
+	require.ErrorIs(t, err, sshush.ErrInvalidHostKey)
+}
+
+func TestPruneKnownHosts(t *testing.T) {
+	contents, err := os.ReadFile(filepath.Join("testdata", "known_hosts", "known_hosts"))
+	require.NoError(t, err)
+
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKeeGsgoD9IRgB7WhCKiqKNiuXoAvr6tIxzW3Ow6pYkk"
+
+	wantPruned := []string{
+		// 10.0.0.9, hashed.
+		"|1|lGW9BCWzRvPDw0xV3+eAck7oMN4=|rRtYWR8svQJzD9RBP4ZKI4GIt9c= " + key,
+		"old-web " + key,
+		// Only known on port 2201.
+		"10.0.0.2 " + key,
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dry run %t", dryRun), func(t *testing.T) {
+			var out bytes.Buffer
+
+			fsys := memFS{fstest.MapFS{"known_hosts": {Data: contents}}}
+
+			runner := &sshush.Runner{
+				Sources: []string{filepath.Join("testdata", "known_hosts", "hosts.yml")},
+				Out:     &out,
+			}
+
+			pruned, err := runner.PruneKnownHosts(context.Background(), sshush.Options{
+				FS:       fsys,
+				SourceFS: sshush.OSFileSystem{},
+				DryRun:   dryRun,
+			}, "known_hosts", []string{"github.com"}, true)
+			require.NoError(t, err)
+			assert.Equal(t, wantPruned, pruned)
+
+			pruneResult := string(fsys.MapFS["known_hosts"].Data)
+
+			if dryRun {
+				assert.Equal(t, string(contents), pruneResult)
+				assert.Contains(t, out.String(), "-old-web "+key)
+
+				return
+			}
+
+			assert.Equal(t, contents, fsys.MapFS["known_hosts.bak"].Data)
+
+			for _, line := range wantPruned {
+				assert.NotContains(t, pruneResult, "\n"+line+"\n")
+			}
+
+			assert.Contains(t, pruneResult, "# Hosts from before sshush\n")
+			assert.Contains(t, pruneResult, "\nedge-1.routers.example.com "+key+"\n")
+			assert.Contains(t, pruneResult, "\n@revoked old-web "+key+"\n")
+			assert.Contains(t, pruneResult, "\n@cert-authority *.example.com "+key+"\n")
+			assert.Len(t, strings.Split(strings.TrimSpace(pruneResult), "\n"), 8)
+		})
+	}
+}
+
+func TestPruneKnownHostsManaged(t *testing.T) {
+	contents, err := os.ReadFile(filepath.Join("testdata", "known_hosts", "known_hosts"))
+	require.NoError(t, err)
+
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKeeGsgoD9IRgB7WhCKiqKNiuXoAvr6tIxzW3Ow6pYkk"
+
+	hashed := func(name string) string {
+		salt := []byte("0123456789abcdefghij")
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(name))
+
+		return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" +
+			base64.StdEncoding.EncodeToString(mac.Sum(nil)) + " " + key
+	}
+
+	contents = append(contents, []byte(hashed("gitlab.com")+"\n"+hashed("old-db")+"\n")...)
+
+	fsys := memFS{fstest.MapFS{
+		"known_hosts":     {Data: contents},
+		"known_hosts.bak": {Data: []byte("original\n")},
+		// old-db and old-web were in an earlier config; github.com, gitlab.com
+		// and 10.0.0.9 never were.
+		"config.managed_hosts": {Data: []byte("# Hosts\nold-db\nold-web\nprod-web-1\n")},
+	}}
+
+	runner := &sshush.Runner{
+		Sources:     []string{filepath.Join("testdata", "known_hosts", "hosts.yml")},
+		Destination: "config",
+		Out:         &bytes.Buffer{},
+	}
+
+	opts := sshush.Options{
+		FS:       fsys,
+		SourceFS: sshush.OSFileSystem{},
+		Now:      func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+
+	pruned, err := runner.PruneKnownHosts(
+		context.Background(), opts, "known_hosts", []string{"gitlab.com"}, false,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old-web " + key, hashed("old-db")}, pruned)
+
+	pruneResult := string(fsys.MapFS["known_hosts"].Data)
+	assert.Contains(t, pruneResult, "\ngithub.com "+key+"\n")
+	assert.Contains(t, pruneResult, "\n"+hashed("gitlab.com")+"\n")
+	assert.Contains(t, pruneResult, "\n10.0.0.2 "+key+"\n")
+
+	assert.Equal(t, "original\n", string(fsys.MapFS["known_hosts.bak"].Data))
+	assert.Equal(t, contents, fsys.MapFS["known_hosts.bak.20260102030405"].Data)
+
+	recorded := string(fsys.MapFS["config.managed_hosts"].Data)
+	assert.Contains(t, recorded, "\nold-db\n", "removed hosts stay in the record")
+	assert.Contains(t, recorded, "\nrouter-1.example.com\n")
+	assert.Contains(t, recorded, "\n*.routers.example.com\n")
+}
+
+// TestManagedHostsRecord checks that the hosts are only recorded for
+// known-hosts prune once known_hosts are managed.
+func TestManagedHostsRecord(t *testing.T) {
+	source := fstest.MapFS{"hosts.yml": {Data: []byte("web:\n  Hosts:\n    web-1: 10.0.0.1\n")}}
+
+	tests := []struct {
+		name           string
+		knownHostsFile string
+		existing       fstest.MapFS
+		want           bool
+	}{
+		{name: "unmanaged"},
+		{name: "known hosts file", knownHostsFile: "known_hosts", want: true},
+		{
+			name:     "already recorded",
+			existing: fstest.MapFS{"config.managed_hosts": {Data: []byte("old-web\n")}},
+			want:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := memFS{fstest.MapFS{}}
+			maps.Copy(fsys.MapFS, tt.existing)
+
+			runner := &sshush.Runner{
+				Sources:        []string{"hosts.yml"},
+				Destination:    "config",
+				KnownHostsFile: tt.knownHostsFile,
+				Out:            &bytes.Buffer{},
+			}
+
+			opts := sshush.Options{FS: fsys, SourceFS: source}
+			require.NoError(t, runner.Run(context.Background(), opts))
+
+			recorded, ok := fsys.MapFS["config.managed_hosts"]
+			require.Equal(t, tt.want, ok)
+
+			if tt.want {
+				assert.Contains(t, string(recorded.Data), "\nweb-1\n")
+			}
+
+			generated, err := runner.Generate(context.Background(), opts)
+			require.NoError(t, err)
+
+			upToDate, err := runner.UpToDate(opts, generated)
+			require.NoError(t, err)
+			assert.True(t, upToDate)
+		})
+	}
+}
+
+func TestKeepHashedKnownHosts(t *testing.T) {
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKeeGsgoD9IRgB7WhCKiqKNiuXoAvr6tIxzW3Ow6pYkk"
+
+	// github.com, hashed by ssh-keygen -H.
+	line := "|1|GFS8cp89dldkRJhMljCTiymDlrY=|5eO1SFWk9SIzqhwYpI/giPd3KUA= " + key
+
+	fsys := memFS{fstest.MapFS{"known_hosts": {Data: []byte(line + "\n")}}}
+
+	runner := &sshush.Runner{
+		Sources: []string{filepath.Join("testdata", "known_hosts", "hosts.yml")},
+		Out:     &bytes.Buffer{},
+	}
+
+	pruned, err := runner.PruneKnownHosts(context.Background(), sshush.Options{
+		FS:       fsys,
+		SourceFS: sshush.OSFileSystem{},
+	}, "known_hosts", []string{"github.com"}, true)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+}
+
+func TestCertificate(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	newKey := func() (ssh.Signer, []byte) {
+		t.Helper()
+
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		signer, err := ssh.NewSignerFromKey(private)
+		require.NoError(t, err)
+
+		return signer, ssh.MarshalAuthorizedKey(signer.PublicKey())
+	}
+
+	ca, _ := newKey()
+	identity, identityPub := newKey()
+	_, otherPub := newKey()
+
+	newCert := func(validBefore time.Time, principals ...string) []byte {
+		t.Helper()
+
+		cert := &ssh.Certificate{
+			Key:             identity.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+		}
+		require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+		return ssh.MarshalAuthorizedKey(cert)
+	}
+
+	const source = `work:
+  Config:
+    IdentityFile: keys/id_work
+    Certificate: true
+    User: deploy
+  Hosts:
+    web-1: web-1.example.com
+    web-2: web-2.example.com
+`
+
+	tests := []struct {
+		name     string
+		cert     []byte
+		pub      []byte
+		wantErr  error
+		wantLogs []string
+	}{
+		{
+			name: "valid",
+			cert: newCert(now.Add(time.Hour), "deploy"),
+			pub:  identityPub,
+		},
+		{
+			name:     "expired",
+			cert:     newCert(now.Add(-time.Minute), "deploy"),
+			pub:      identityPub,
+			wantLogs: []string{`msg="certificate has expired" host=web-1`},
+		},
+		{
+			name:     "wrong principal",
+			cert:     newCert(now.Add(time.Hour), "admin"),
+			pub:      identityPub,
+			wantLogs: []string{`msg="certificate principals don't include the user"`},
+		},
+		{
+			name:     "missing",
+			pub:      identityPub,
+			wantLogs: []string{`msg="certificate not found"`},
+		},
+		{
+			name:    "mismatched key",
+			cert:    newCert(now.Add(time.Hour), "deploy"),
+			pub:     otherPub,
+			wantErr: sshush.ErrCertificateMismatch,
+		},
+		{
+			name:    "not a certificate",
+			cert:    otherPub,
+			pub:     identityPub,
+			wantErr: sshush.ErrInvalidCertificate,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			fsys := fstest.MapFS{
+				"hosts.yml":        {Data: []byte(source)},
+				"keys/id_work.pub": {Data: tt.pub},
+			}
+			if tt.cert != nil {
+				fsys["keys/id_work-cert.pub"] = &fstest.MapFile{Data: tt.cert}
+			}
+
+			runner := &sshush.Runner{
+				Sources:     []string{"hosts.yml"},
+				Destination: sshush.StdoutDestination,
+				Out:         &bytes.Buffer{},
+			}
+
+			lines, err := runner.Generate(context.Background(), sshush.Options{
+				SourceFS: fsys,
+				Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+				Now:      func() time.Time { return now },
+			})
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Contains(t, strings.Join(lines.Config, "\n"), strings.Join([]string{
+				"    IdentityFile keys/id_work",
+				"    CertificateFile keys/id_work-cert.pub",
+				"    User deploy",
+			}, "\n"))
+			assert.NotContains(t, strings.Join(lines.Config, "\n"), "Certificate true")
+
+			for _, want := range tt.wantLogs {
+				assert.Contains(t, logs.String(), want)
+				// Checked once for the group, not for each host.
+				assert.Equal(t, 1, strings.Count(logs.String(), want))
+			}
+
+			if tt.wantLogs == nil {
+				assert.NotContains(t, logs.String(), "level=WARN")
+			}
+		})
+	}
+}
+
+func TestCertificateOptOut(t *testing.T) {
+	var logs bytes.Buffer
+
+	runner := &sshush.Runner{
+		Sources:     []string{"hosts.yml"},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	lines, err := runner.Generate(context.Background(), sshush.Options{
+		Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+		SourceFS: fstest.MapFS{"hosts.yml": {Data: []byte(`work:
+  Config:
+    IdentityFile: keys/id_work
+    Certificate: true
+  Hosts:
+    web-1:
+      HostName: web-1.example.com
+      Certificate: false
+`)}},
+	})
+	require.NoError(t, err)
+
+	config := strings.Join(lines.Config, "\n")
+	assert.Contains(t, config, "    IdentityFile keys/id_work")
+	assert.NotContains(t, config, "Certificate")
+	assert.Empty(t, logs.String())
+}
+
+func TestCertificateWithoutIdentity(t *testing.T) {
+	runner := &sshush.Runner{
+		Sources:     []string{"hosts.yml"},
+		Destination: sshush.StdoutDestination,
+		Out:         &bytes.Buffer{},
+	}
+
+	_, err := runner.Generate(context.Background(), sshush.Options{
+		SourceFS: fstest.MapFS{"hosts.yml": {Data: []byte(
+			"web:\n  Hosts:\n    web-1:\n      Certificate: ~/.ssh/id_work-cert.pub\n",
+		)}},
+	})
+	require.ErrorIs(t, err, sshush.ErrCertificateWithoutIdentity)
+}
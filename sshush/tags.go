@@ -0,0 +1,106 @@
+package sshush
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// tagsBlock is the key tags are declared under, on a group or a host.
+const tagsBlock = "Tags"
+
+var ErrTagsNotListOfStrings = errors.New("tags is not a list of strings")
+
+// getTags returns the tags declared in a group or host's config. A single
+// tag may be given as a string rather than a list.
+func getTags(configMap map[string]any) ([]string, error) {
+	switch tags := configMap[tagsBlock].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{tags}, nil
+	case []any:
+		tagStrings := make([]string, 0, len(tags))
+
+		for _, tag := range tags {
+			tagString, ok := tag.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %v", ErrTagsNotListOfStrings, tags)
+			}
+
+			tagStrings = append(tagStrings, tagString)
+		}
+
+		return tagStrings, nil
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrTagsNotListOfStrings, tags)
+	}
+}
+
+// mergeTags returns the tags from every list, sorted and without duplicates.
+func mergeTags(tagLists ...[]string) []string {
+	merged := []string{}
+
+	for _, tags := range tagLists {
+		merged = append(merged, tags...)
+	}
+
+	sort.Strings(merged)
+
+	return slices.Compact(merged)
+}
+
+// FilterTags returns a copy of the config with only the hosts that have at
+// least one of the include tags, if any are given, and none of the exclude
+// tags. Groups left without any hosts are dropped, but groups that never had
+// any, such as those only used through Extends, are kept.
+func (c *Config) FilterTags(include, exclude []string) *Config {
+	filtered := *c
+	filtered.Groups = []Group{}
+
+	for _, group := range c.Groups {
+		if len(group.Hosts) == 0 {
+			filtered.Groups = append(filtered.Groups, group)
+
+			continue
+		}
+
+		hosts := []Host{}
+
+		for _, host := range group.Hosts {
+			if host.matchesTags(include, exclude) {
+				hosts = append(hosts, host)
+			}
+		}
+
+		if len(hosts) > 0 {
+			group.Hosts = hosts
+			filtered.Groups = append(filtered.Groups, group)
+		}
+	}
+
+	return &filtered
+}
+
+// matchesTags reports whether the host has at least one of the include tags,
+// if any are given, and none of the exclude tags.
+func (h Host) matchesTags(include, exclude []string) bool {
+	for _, tag := range exclude {
+		if slices.Contains(h.Tags, tag) {
+			return false
+		}
+	}
+
+	if len(include) == 0 {
+		return true
+	}
+
+	for _, tag := range include {
+		if slices.Contains(h.Tags, tag) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,230 @@
+package sshush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+)
+
+const (
+	// terraformBlock is the key of a group's Terraform provider block.
+	terraformBlock = "Terraform"
+	// terraformStateVersion is the only version of the state format we read.
+	terraformStateVersion = 4
+)
+
+type (
+	// terraformMapping is a group's Terraform block: the state file, which of
+	// its resources are hosts, and which attributes to use for them.
+	terraformMapping struct {
+		// State is the path of the terraform.tfstate file, relative to the
+		// source.
+		State string `yaml:"State"`
+		// Type limits the resources to those of the type, e.g. aws_instance.
+		Type string `yaml:"Type"`
+		// Address limits the resources to those whose address matches the
+		// glob, e.g. module.web.aws_instance.*.
+		Address string `yaml:"Address"`
+		// Alias is the attribute to name the host by, e.g. tags.Name.
+		// Defaults to the resource's name, with its index if it has one.
+		Alias string `yaml:"Alias"`
+		// HostName is the attribute to use as the HostName, e.g. public_ip.
+		HostName string `yaml:"HostName"`
+	}
+
+	// terraformState is the part of a version 4 state file we need.
+	terraformState struct {
+		Version   int                 `json:"version"`
+		Resources []terraformResource `json:"resources"`
+	}
+
+	terraformResource struct {
+		Module    string              `json:"module"`
+		Mode      string              `json:"mode"`
+		Type      string              `json:"type"`
+		Name      string              `json:"name"`
+		Instances []terraformInstance `json:"instances"`
+	}
+
+	terraformInstance struct {
+		IndexKey   any            `json:"index_key"`
+		Attributes map[string]any `json:"attributes"`
+	}
+)
+
+var ErrTerraformState = errors.New("invalid terraform state")
+
+// terraformHosts returns the hosts from the resources in a Terraform state
+// file that match the mapping. Instances without a HostName, such as those
+// not yet given an IP, are skipped with a warning, as are instances with the
+// same alias as an earlier one.
+func (p *Parser) terraformHosts(
+	ctx context.Context,
+	source string,
+	block any,
+) (map[string]any, error) {
+	var mapping terraformMapping
+
+	err := decodeBlock(block, &mapping)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", terraformBlock, err)
+	}
+
+	if mapping.State == "" || mapping.HostName == "" {
+		return nil, fmt.Errorf(
+			"%w: %s needs State and HostName",
+			ErrProviderMapping,
+			terraformBlock,
+		)
+	}
+
+	contents, statePath, err := p.readProviderFile(ctx, source, mapping.State)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := readTerraformState(statePath, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]any)
+	addresses := make(map[string]string)
+
+	for _, resource := range state.Resources {
+		matched, err := mapping.matches(resource)
+		if err != nil {
+			return nil, err
+		}
+
+		if !matched {
+			continue
+		}
+
+		for _, instance := range resource.Instances {
+			alias, ok := mapping.alias(resource, instance)
+			if !ok {
+				p.logger().Warn("terraform instance has no alias", "resource", resource.address())
+
+				continue
+			}
+
+			hostName, ok := attributeValue(instance.Attributes, mapping.HostName)
+			if !ok {
+				p.logger().Warn("terraform instance has no "+mapping.HostName, "host", alias)
+
+				continue
+			}
+
+			address := resource.instanceAddress(instance)
+
+			if first, ok := addresses[alias]; ok {
+				p.logger().Warn(
+					"skipping terraform instance with the same alias as another",
+					"host", alias, "first", first, "second", address,
+				)
+
+				continue
+			}
+
+			addresses[alias] = address
+			hosts[alias] = hostName
+		}
+	}
+
+	p.debugf("Terraform hosts from %s: %v\n", statePath, hosts)
+
+	return hosts, nil
+}
+
+// readTerraformState parses a version 4 state file.
+func readTerraformState(statePath string, contents []byte) (*terraformState, error) {
+	var state terraformState
+
+	err := json.Unmarshal(contents, &state)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrTerraformState, statePath, err)
+	}
+
+	if state.Version != terraformStateVersion {
+		return nil, fmt.Errorf(
+			"%w: %s: version %d, expected %d",
+			ErrTerraformState,
+			statePath,
+			state.Version,
+			terraformStateVersion,
+		)
+	}
+
+	return &state, nil
+}
+
+// matches reports whether the resource is one of the mapping's hosts. Only
+// managed resources, not data sources, can be.
+func (m terraformMapping) matches(resource terraformResource) (bool, error) {
+	if resource.Mode != "managed" {
+		return false, nil
+	}
+
+	filters := [][2]string{{m.Type, resource.Type}, {m.Address, resource.address()}}
+
+	for _, filter := range filters {
+		pattern, value := filter[0], filter[1]
+		if pattern == "" {
+			continue
+		}
+
+		matched, err := path.Match(pattern, value)
+		if err != nil {
+			return false, fmt.Errorf("%w: %s: %w", ErrProviderMapping, pattern, err)
+		}
+
+		if !matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// alias returns the name of the host for an instance of the resource.
+func (m terraformMapping) alias(
+	resource terraformResource,
+	instance terraformInstance,
+) (string, bool) {
+	if m.Alias != "" {
+		return attributeValue(instance.Attributes, m.Alias)
+	}
+
+	if instance.IndexKey == nil {
+		return resource.Name, true
+	}
+
+	return fmt.Sprintf("%s-%v", resource.Name, instance.IndexKey), true
+}
+
+// address returns the resource's address, without an instance index, e.g.
+// module.web.aws_instance.app.
+func (r terraformResource) address() string {
+	address := r.Type + "." + r.Name
+	if r.Module != "" {
+		address = r.Module + "." + address
+	}
+
+	return address
+}
+
+// instanceAddress returns the address of an instance of the resource, with
+// its index if it has one, e.g. aws_instance.app[0].
+func (r terraformResource) instanceAddress(instance terraformInstance) string {
+	switch key := instance.IndexKey.(type) {
+	case nil:
+		return r.address()
+	case string:
+		return fmt.Sprintf("%s[%q]", r.address(), key)
+	default:
+		return fmt.Sprintf("%s[%v]", r.address(), key)
+	}
+}